@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Token categories counted by analyze, in chart order
+var analyzeCategories = []string{"date", "time", "iata", "icao", "other", "unknown"}
+
+// Category of a substitution; anything left as written counts as unknown
+func analyzeCategory(sub Substitution) string {
+	switch {
+	case !sub.Replaced:
+		return "unknown"
+	case sub.kind == tokenDate:
+		return "date"
+	case sub.kind == tokenTime12 || sub.kind == tokenTime24:
+		return "time"
+	case sub.kind == tokenIATA:
+		return "iata"
+	case sub.kind == tokenICAO:
+		return "icao"
+	}
+	return "other"
+}
+
+// Statistics for one document
+type documentStats struct {
+	File      string         `json:"file"`
+	Tokens    map[string]int `json:"tokens"`
+	LatencyMS float64        `json:"latency_ms"`
+}
+
+// Statistics for the whole corpus
+type corpusStats struct {
+	Documents []documentStats    `json:"documents"`
+	Tokens    map[string]int     `json:"tokens"`
+	Latency   latencyPercentiles `json:"latency_ms"`
+	Failed    []string           `json:"failed,omitempty"` // documents that timed out
+}
+
+type latencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// Run the analyze subcommand: process every given file (or every file in a
+// given directory) without writing output, and report token counts and
+// processing times. Returns the process exit code.
+func runAnalyze(args []string) int {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	readOptions := optionFlags(fs)
+	jsonFile := fs.String("json", "", "Also write the statistics as JSON to this file")
+	timeout := fs.Duration("per-file-timeout", 0, "Skip a document that takes longer than this to process, e.g. 5s")
+	fs.Parse(args)
+
+	opts, err := readOptions()
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	if fs.NArg() < 2 {
+		fmt.Println("Incorrect number of arguments")
+		fmt.Println("Analyze usage:\n go run . analyze [options] [-json stats.json] ./airport-lookup.csv ./docs...")
+		return 2
+	}
+
+	store := newStorage(opts.http)
+	airportLookup, opts, err := loadResources(store, fs.Arg(0), opts)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	files, err := expandInputs(fs.Args()[1:])
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	stats := corpusStats{Tokens: make(map[string]int)}
+	var latencies []float64
+	for _, file := range files {
+		input, err := store.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Input %s not found\n", file)
+			return 1
+		}
+
+		start := time.Now()
+		result, ok := processTextWithin(*timeout, string(input), airportLookup, opts)
+		latency := float64(time.Since(start).Microseconds()) / 1000
+		if !ok {
+			stats.Failed = append(stats.Failed, file)
+			continue
+		}
+
+		doc := documentStats{File: file, Tokens: make(map[string]int), LatencyMS: latency}
+		for _, category := range analyzeCategories {
+			doc.Tokens[category] = 0
+		}
+		for _, sub := range result.Substitutions {
+			category := analyzeCategory(sub)
+			doc.Tokens[category]++
+			stats.Tokens[category]++
+		}
+		stats.Documents = append(stats.Documents, doc)
+		latencies = append(latencies, latency)
+	}
+	stats.Latency = percentiles(latencies)
+
+	fmt.Print(formatHistogram(stats))
+
+	if *jsonFile != "" {
+		data, _ := json.MarshalIndent(stats, "", "  ")
+		if err := store.WriteFile(*jsonFile, append(data, '\n')); err != nil {
+			fmt.Println("Error writing to JSON file")
+			return 1
+		}
+	}
+	return 0
+}
+
+// Replace directories in the arguments by the files directly inside them
+func expandInputs(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil || !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Directory %s not readable", arg)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(arg, entry.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// Nearest-rank percentiles of the latencies
+func percentiles(latencies []float64) latencyPercentiles {
+	if len(latencies) == 0 {
+		return latencyPercentiles{}
+	}
+	sorted := append([]float64(nil), latencies...)
+	sort.Float64s(sorted)
+	rank := func(p float64) float64 {
+		i := int(p*float64(len(sorted))+0.999999) - 1
+		return sorted[max(0, min(i, len(sorted)-1))]
+	}
+	return latencyPercentiles{P50: rank(0.5), P90: rank(0.9), P99: rank(0.99), Max: sorted[len(sorted)-1]}
+}
+
+// ASCII bar chart of the token counts followed by the latency percentiles
+func formatHistogram(stats corpusStats) string {
+	const width = 40
+	most := 0
+	for _, count := range stats.Tokens {
+		most = max(most, count)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Tokens in %d documents\n", len(stats.Documents))
+	for _, category := range analyzeCategories {
+		count := stats.Tokens[category]
+		bar := 0
+		if most > 0 {
+			bar = count * width / most
+		}
+		fmt.Fprintf(&b, "  %-8s %-*s %d\n", category, width, strings.Repeat("#", bar), count)
+	}
+	fmt.Fprintf(&b, "Latency (ms): p50 %.3f  p90 %.3f  p99 %.3f  max %.3f\n",
+		stats.Latency.P50, stats.Latency.P90, stats.Latency.P99, stats.Latency.Max)
+	if len(stats.Failed) > 0 {
+		fmt.Fprintf(&b, "Timed out (%d): %s\n", len(stats.Failed), strings.Join(stats.Failed, ", "))
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Run the test-corpus subcommand: process every NAME.input.txt in a
+// directory and compare the result with NAME.expected.txt. Returns the
+// process exit code.
+func runTestCorpus(args []string) int {
+	fs := flag.NewFlagSet("test-corpus", flag.ExitOnError)
+	readOptions := optionFlags(fs)
+	timeout := fs.Duration("per-file-timeout", 0, "Fail a document that takes longer than this to process, e.g. 5s")
+	fs.Parse(args)
+
+	opts, err := readOptions()
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	if fs.NArg() != 2 {
+		fmt.Println("Incorrect number of arguments")
+		fmt.Println("Test corpus usage:\n go run . test-corpus [options] ./corpus ./airport-lookup.csv")
+		return 2
+	}
+	corpusDir, lookupFile := fs.Arg(0), fs.Arg(1)
+
+	store := newStorage(opts.http)
+	airportLookup, opts, err := loadResources(store, lookupFile, opts)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	inputs, err := filepath.Glob(filepath.Join(corpusDir, "*.input.txt"))
+	if err != nil || len(inputs) == 0 {
+		fmt.Println("No *.input.txt files in corpus")
+		return 2
+	}
+	sort.Strings(inputs)
+
+	// Process every pair and report mismatches
+	failed := 0
+	for _, inputFile := range inputs {
+		name := strings.TrimSuffix(filepath.Base(inputFile), ".input.txt")
+
+		input, err := store.ReadFile(inputFile)
+		if err != nil {
+			fmt.Printf("FAIL %s: input not readable\n", name)
+			failed++
+			continue
+		}
+		expected, err := store.ReadFile(strings.TrimSuffix(inputFile, ".input.txt") + ".expected.txt")
+		if err != nil {
+			fmt.Printf("FAIL %s: expected output not found\n", name)
+			failed++
+			continue
+		}
+
+		result, ok := processTextWithin(*timeout, string(input), airportLookup, opts)
+		if !ok {
+			fmt.Printf("FAIL %s: timed out after %s\n", name, *timeout)
+			failed++
+			continue
+		}
+		got := result.Text
+		if got == string(expected) {
+			fmt.Printf("ok   %s\n", name)
+			continue
+		}
+		fmt.Printf("FAIL %s\n", name)
+		fmt.Print(diffLines(string(expected), got))
+		failed++
+	}
+
+	fmt.Printf("%d passed, %d failed\n", len(inputs)-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Line diff of expected and actual text. Only changed lines are printed,
+// prefixed with their line number in the expected (-) or actual (+) text.
+func diffLines(expected, actual string) string {
+	a := strings.Split(expected, "\n")
+	b := strings.Split(actual, "\n")
+
+	// Longest common subsequence table, filled from the end
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&out, "  -%4d | %s\n", i+1, a[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "  +%4d | %s\n", j+1, b[j])
+			j++
+		}
+	}
+	return out.String()
+}
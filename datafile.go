@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A record of a CSV data file with the line it starts on
+type dataRow struct {
+	line   int
+	fields []string
+}
+
+// Problems found in a data file. Loaders note every bad row instead of
+// stopping at the first one, so a single run lists everything to fix.
+type dataProblems struct {
+	what string // e.g. "Airport overrides"
+	list []dataProblem
+}
+
+type dataProblem struct {
+	line int
+	text string
+}
+
+func (p *dataProblems) add(line int, format string, args ...any) {
+	p.list = append(p.list, dataProblem{line, fmt.Sprintf(format, args...)})
+}
+
+// All problems in file order, or nil when there are none
+func (p *dataProblems) err() error {
+	if len(p.list) == 0 {
+		return nil
+	}
+	sort.SliceStable(p.list, func(i, j int) bool { return p.list[i].line < p.list[j].line })
+	msg := p.what + " malformed:"
+	for _, problem := range p.list {
+		msg += fmt.Sprintf("\n  line %d: %s", problem.line, problem.text)
+	}
+	return errors.New(msg)
+}
+
+// Read a CSV data file whose rows have the given number of fields. When
+// header is given the first record must be exactly that and is not
+// returned. Rows with the wrong number of fields are noted and left out,
+// so callers can index the fields freely.
+func readDataCSV(store Storage, path, what string, fields int, header []string) ([]dataRow, *dataProblems, error) {
+	data, err := store.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s not found", what)
+	}
+	problems := &dataProblems{what: what}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	var rows []dataRow
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			if first && header != nil {
+				problems.add(1, "file is empty, expected the header %s", strings.Join(header, ","))
+			}
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			problems.add(parseErr.Line, "%v", parseErr.Err)
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := r.FieldPos(0)
+
+		if first && header != nil {
+			if strings.Join(record, ",") != strings.Join(header, ",") {
+				problems.add(line, "header must be %s, got %s", strings.Join(header, ","), strings.Join(record, ","))
+			}
+			continue
+		}
+		if len(record) != fields {
+			problems.add(line, "expected %d fields, got %d", fields, len(record))
+			continue
+		}
+		rows = append(rows, dataRow{line: line, fields: record})
+	}
+	return rows, problems, nil
+}
+
+// Check an airport code column value written without #
+func checkAirportCode(problems *dataProblems, line int, code string) {
+	switch {
+	case strings.HasPrefix(code, "#"):
+		problems.add(line, "code %q: write codes without #, e.g. %s", code, strings.TrimLeft(code, "#"))
+	case len(code) != 3 && len(code) != 4:
+		problems.add(line, "code %q: must be 3 (IATA) or 4 (ICAO) characters", code)
+	}
+}
+
+// The candidate closest to s, if it is close enough to be a likely typo
+func suggest(s string, candidates []string) (string, bool) {
+	best, bestDistance := "", 3
+	for _, c := range candidates {
+		if d := editDistance(s, c); d < bestDistance {
+			best, bestDistance = c, d
+		}
+	}
+	return best, best != ""
+}
+
+// Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Encrypted files are laid out as magic, salt, nonce, then the AES-256-GCM
+// ciphertext. The key is derived from the passphrase with PBKDF2-HMAC-SHA256.
+const (
+	encryptionMagic      = "AIRPORTCODES-AESGCM-1\n"
+	encryptionSaltSize   = 16
+	encryptionIterations = 600000
+)
+
+// Storage wrapper that encrypts everything written through it. Reads are
+// passed through unchanged.
+type encryptingStorage struct {
+	Storage
+	passphrase []byte
+}
+
+func (s encryptingStorage) WriteFile(name string, data []byte) error {
+	sealed, err := encrypt(data, s.passphrase)
+	if err != nil {
+		return err
+	}
+	return s.Storage.WriteFile(name, sealed)
+}
+
+// Read the passphrase from the first line of a file
+func loadPassphrase(store Storage, path string) ([]byte, error) {
+	data, err := store.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Passphrase file not found")
+	}
+	passphrase, _, _ := strings.Cut(string(data), "\n")
+	passphrase = strings.TrimSuffix(passphrase, "\r")
+	if passphrase == "" {
+		return nil, fmt.Errorf("Passphrase file is empty")
+	}
+	return []byte(passphrase), nil
+}
+
+func encrypt(plaintext, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(encryptionMagic), salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, []byte(encryptionMagic)), nil
+}
+
+func decrypt(sealed, passphrase []byte) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, []byte(encryptionMagic)) {
+		return nil, fmt.Errorf("File is not encrypted")
+	}
+	sealed = sealed[len(encryptionMagic):]
+	if len(sealed) < encryptionSaltSize {
+		return nil, fmt.Errorf("Encrypted file is truncated")
+	}
+	gcm, err := newGCM(passphrase, sealed[:encryptionSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[encryptionSaltSize:]
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Encrypted file is truncated")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(encryptionMagic))
+	if err != nil {
+		return nil, fmt.Errorf("Wrong passphrase or damaged file")
+	}
+	return plaintext, nil
+}
+
+func newGCM(passphrase, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2SHA256(passphrase, salt, encryptionIterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PBKDF2 with HMAC-SHA256 as defined in RFC 8018
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// Run the decrypt subcommand: turn a file written with -encrypt-key-file
+// back into plain text. Returns the process exit code.
+func runDecrypt(args []string) int {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "File holding the passphrase")
+	httpOpts := httpFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 || *keyFile == "" {
+		fmt.Println("Incorrect number of arguments")
+		fmt.Println("Decrypt usage:\n go run . decrypt -key-file ./passphrase.txt ./output.enc ./output.txt")
+		return 2
+	}
+
+	store := newStorage(*httpOpts)
+	passphrase, err := loadPassphrase(store, *keyFile)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	sealed, err := store.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Println("Input not found")
+		return 1
+	}
+	plaintext, err := decrypt(sealed, passphrase)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err := store.WriteFile(fs.Arg(1), plaintext); err != nil {
+		fmt.Println("Error writing to output file")
+		return 1
+	}
+	return 0
+}
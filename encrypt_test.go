@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// RFC 7914 section 11, and a 32-byte key as used for AES-256
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, tt := range tests {
+		want, _ := hex.DecodeString(tt.want)
+		got := pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations, len(want))
+		if !bytes.Equal(got, want) {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %x, want %x", tt.password, tt.salt, tt.iterations, got, want)
+		}
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	plaintext := []byte("Fly from Hannover Airport on 01 Mar 2024\n")
+	sealed, err := encrypt(plaintext, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Error("ciphertext contains the plaintext")
+	}
+
+	got, err := decrypt(sealed, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("decrypt = %q, want %q", got, plaintext)
+	}
+
+	if _, err := decrypt(sealed, []byte("wrong horse")); err == nil {
+		t.Error("decrypt with the wrong passphrase succeeded")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := decrypt(sealed, []byte("correct horse")); err == nil {
+		t.Error("decrypt of tampered data succeeded")
+	}
+}
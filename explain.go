@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Substitution records what happened to one token, for -explain
+type Substitution struct {
+	Line        int    // 1-based line in the input
+	Token       string // the token as written
+	Replacement string // empty when the token was left as written
+	Replaced    bool
+	Rule        string // which rule matched the token
+	Source      string // where the replacement came from
+	InputStart  int    // byte range of the token in the input
+	InputEnd    int
+	OutputStart int // byte range of what was written for it in the output,
+	OutputEnd   int // -1 when a post-processor couldn't say where it went
+
+	kind tokenKind
+}
+
+// Names of the rules behind each token kind
+var tokenRules = map[tokenKind]string{
+	tokenICAO:      "ICAO code (##, tried before #)",
+	tokenIATA:      "IATA code (#)",
+	tokenDate:      "date D(...)",
+	tokenTime12:    "12-hour time T12(...)",
+	tokenTime24:    "24-hour time T24(...)",
+	tokenPNR:       "booking reference PNR(...)",
+	tokenTicket:    "ticket number TKT(...)",
+	tokenCurrency:  "currency amount CUR(...)",
+	tokenPhone:     "phone number TEL(...)",
+	tokenBaggage:   "baggage allowance BAG(...)",
+	tokenSeat:      "seat ST(...) / NSST",
+	tokenCodeshare: "codeshare OPERATED BY",
+	tokenFlight:    "flight number FLT(...)",
+}
+
+func newSubstitution(text string, tok token, line int, replacement string, replaced bool, airportLookup *AirportLookup) Substitution {
+	sub := Substitution{
+		Line:     line,
+		Token:    text[tok.start:tok.end],
+		Replaced: replaced,
+		Rule:     tokenRules[tok.kind],
+
+		InputStart: tok.start,
+		InputEnd:   tok.end,
+
+		kind: tok.kind,
+	}
+	if replaced {
+		sub.Replacement = replacement
+	}
+
+	switch {
+	case (tok.kind == tokenICAO || tok.kind == tokenIATA) && replaced:
+		airport, _ := airportLookup.Get(sub.Token)
+		sub.Source = fmt.Sprintf("lookup line %d (%s, %s)", airport.Line, airport.ICAO, airport.IATA)
+		if airport.NameSource != "" {
+			sub.Source += ", name from " + airport.NameSource
+		}
+	case tok.kind == tokenICAO || tok.kind == tokenIATA:
+		sub.Source = "code not in lookup"
+	case !replaced:
+		sub.Source = "contents could not be parsed"
+	}
+	return sub
+}
+
+// Plain text report of all substitutions, one block per token
+func formatExplanation(substitutions []Substitution) string {
+	var b strings.Builder
+	for _, sub := range substitutions {
+		if sub.Replaced {
+			fmt.Fprintf(&b, "line %d: %s -> %s\n", sub.Line, sub.Token, sub.Replacement)
+		} else {
+			fmt.Fprintf(&b, "line %d: %s left as is\n", sub.Line, sub.Token)
+		}
+		fmt.Fprintf(&b, "    rule: %s\n", sub.Rule)
+		if sub.Source != "" {
+			fmt.Fprintf(&b, "    from: %s\n", sub.Source)
+		}
+	}
+	return b.String()
+}
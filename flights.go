@@ -0,0 +1,60 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Carrier code (two characters with at least one letter, or three letters
+// for ICAO designators), flight number and optional operational suffix
+var flightNumberRegex = regexp.MustCompile(`^([A-Z][A-Z0-9]|[0-9][A-Z]|[A-Z]{3})0*([0-9]{1,4})([A-Z]?)$`)
+
+// Normalize a flight designator such as "lh 0441" to "LH441". Returns the
+// carrier code separately so it can be checked against the airlines.
+func normalizeFlightNumber(body string) (flight, carrier string, ok bool) {
+	parts := flightNumberRegex.FindStringSubmatch(strings.ToUpper(stripSeparators(body)))
+	if parts == nil || parts[2] == "0" {
+		return "", "", false
+	}
+	return parts[1] + parts[2] + parts[3], parts[1], true
+}
+
+// Read airlines from a CSV file with a code,name header. Codes are the
+// two-character IATA or three-letter ICAO designators.
+func loadAirlines(store Storage, path string) (map[string]string, error) {
+	rows, problems, err := readDataCSV(store, path, "Airlines", 2, []string{"code", "name"})
+	if err != nil {
+		return nil, err
+	}
+
+	airlines := make(map[string]string)
+	for _, row := range rows {
+		code := strings.ToUpper(row.fields[0])
+		if !regexp.MustCompile(`^([A-Z0-9]{2}|[A-Z]{3})$`).MatchString(code) {
+			problems.add(row.line, "code %q: must be a 2-character IATA or 3-letter ICAO designator", row.fields[0])
+		}
+		if row.fields[1] == "" {
+			problems.add(row.line, "name is empty")
+		}
+		airlines[code] = row.fields[1]
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return airlines, nil
+}
+
+// The airline name for the carrier of an OPERATED BY line, matched against
+// the -airlines codes and names, so "KLM" keeps its casing instead of
+// being title-cased
+func airlineName(carrier string, airlines map[string]string) (string, bool) {
+	if name := airlines[strings.ToUpper(carrier)]; name != "" {
+		return name, true
+	}
+	for _, name := range airlines {
+		if strings.EqualFold(name, carrier) {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Rewrite a JSON document, running processText on the string values at the
+// -json-fields paths. A path is dot-separated keys where array elements are
+// numbered from 0 and * matches any key or element, e.g. "notes" or
+// "legs.*.remark". Key order and all other values are kept as they are.
+func processJSON(input []byte, airportLookup *AirportLookup, opts options) (processResult, error) {
+	var patterns [][]string
+	for _, field := range opts.jsonFields {
+		patterns = append(patterns, strings.Split(field, "."))
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	dec.UseNumber()
+	r := jsonRewriter{dec: dec, patterns: patterns, airportLookup: airportLookup, opts: opts}
+	if err := r.value(nil); err != nil {
+		return processResult{}, fmt.Errorf("Input is not valid JSON")
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return processResult{}, fmt.Errorf("Input is not valid JSON")
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, r.out.Bytes(), "", "  "); err != nil {
+		return processResult{}, err
+	}
+	out.WriteByte('\n')
+	r.result.Text = out.String()
+	return r.result, nil
+}
+
+// Copies JSON tokens from dec to out, processing the matching strings
+type jsonRewriter struct {
+	dec           *json.Decoder
+	out           bytes.Buffer
+	patterns      [][]string
+	airportLookup *AirportLookup
+	opts          options
+	result        processResult // warnings and substitutions of all fields
+}
+
+// Copy the next value, found at path
+func (r *jsonRewriter) value(path []string) error {
+	tok, err := r.dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '{' {
+			r.out.WriteByte('{')
+			for i := 0; r.dec.More(); i++ {
+				key, err := r.dec.Token()
+				if err != nil {
+					return err
+				}
+				if i > 0 {
+					r.out.WriteByte(',')
+				}
+				r.writeString(key.(string))
+				r.out.WriteByte(':')
+				if err := r.value(append(path[:len(path):len(path)], key.(string))); err != nil {
+					return err
+				}
+			}
+			r.out.WriteByte('}')
+		} else {
+			r.out.WriteByte('[')
+			for i := 0; r.dec.More(); i++ {
+				if i > 0 {
+					r.out.WriteByte(',')
+				}
+				if err := r.value(append(path[:len(path):len(path)], strconv.Itoa(i))); err != nil {
+					return err
+				}
+			}
+			r.out.WriteByte(']')
+		}
+		_, err := r.dec.Token() // closing delimiter
+		return err
+
+	case string:
+		if !r.matches(path) {
+			r.writeString(tok)
+			return nil
+		}
+		result := processText(tok, r.airportLookup, r.opts)
+		for _, warning := range result.Warnings {
+			warning.Field = strings.Join(path, ".")
+			r.result.Warnings = append(r.result.Warnings, warning)
+		}
+		r.result.Substitutions = append(r.result.Substitutions, result.Substitutions...)
+		r.writeString(result.Text)
+
+	case json.Number:
+		r.out.WriteString(tok.String())
+
+	default: // bool or null
+		data, _ := json.Marshal(tok)
+		r.out.Write(data)
+	}
+	return nil
+}
+
+// Report whether path is one of the -json-fields
+func (r *jsonRewriter) matches(path []string) bool {
+	for _, pattern := range r.patterns {
+		if len(pattern) != len(path) {
+			continue
+		}
+		match := true
+		for i := range pattern {
+			if pattern[i] != "*" && pattern[i] != path[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// Write s as a JSON string, leaving <, > and & readable
+func (r *jsonRewriter) writeString(s string) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	r.out.Write(bytes.TrimSuffix(b.Bytes(), []byte("\n")))
+}
@@ -0,0 +1,128 @@
+package main
+
+import "testing"
+
+func TestProcessJSON(t *testing.T) {
+	input := `{"notes": "Fly #HAJ", "id": "#HAJ", "pax": 2, "vip": false, "seat": null,
+	"legs": [{"remark": "To ##EETN", "code": "#TLL"}, {"remark": "Back to #HAJ", "miles": 1.50}],
+	"extra": {"a": "#TLL", "b": ["#HAJ", "#TLL"]}}`
+	tests := []struct {
+		fields string
+		want   string
+	}{
+		{"notes", `{
+  "notes": "Fly Hannover Airport",
+  "id": "#HAJ",
+  "pax": 2,
+  "vip": false,
+  "seat": null,
+  "legs": [
+    {
+      "remark": "To ##EETN",
+      "code": "#TLL"
+    },
+    {
+      "remark": "Back to #HAJ",
+      "miles": 1.50
+    }
+  ],
+  "extra": {
+    "a": "#TLL",
+    "b": [
+      "#HAJ",
+      "#TLL"
+    ]
+  }
+}
+`},
+		{"legs.*.remark,extra.*", `{
+  "notes": "Fly #HAJ",
+  "id": "#HAJ",
+  "pax": 2,
+  "vip": false,
+  "seat": null,
+  "legs": [
+    {
+      "remark": "To Lennart Meri Tallinn Airport",
+      "code": "#TLL"
+    },
+    {
+      "remark": "Back to Hannover Airport",
+      "miles": 1.50
+    }
+  ],
+  "extra": {
+    "a": "Lennart Meri Tallinn Airport",
+    "b": [
+      "#HAJ",
+      "#TLL"
+    ]
+  }
+}
+`},
+		{"legs.1.remark,extra.b.0", `{
+  "notes": "Fly #HAJ",
+  "id": "#HAJ",
+  "pax": 2,
+  "vip": false,
+  "seat": null,
+  "legs": [
+    {
+      "remark": "To ##EETN",
+      "code": "#TLL"
+    },
+    {
+      "remark": "Back to Hannover Airport",
+      "miles": 1.50
+    }
+  ],
+  "extra": {
+    "a": "#TLL",
+    "b": [
+      "Hannover Airport",
+      "#TLL"
+    ]
+  }
+}
+`},
+	}
+	for _, tt := range tests {
+		result, err := processJSON([]byte(input), testLookup(), testOptions(t, "-json-fields", tt.fields))
+		if err != nil {
+			t.Errorf("-json-fields %s: %v", tt.fields, err)
+			continue
+		}
+		if result.Text != tt.want {
+			t.Errorf("-json-fields %s:\n%s\nwant:\n%s", tt.fields, result.Text, tt.want)
+		}
+	}
+}
+
+func TestProcessJSONWarnings(t *testing.T) {
+	input := `{"legs": [{"remark": "Fly #HAJ"}, {"remark": "Fly #XXX"}]}`
+	result, err := processJSON([]byte(input), testLookup(), testOptions(t, "-json-fields", "legs.*.remark"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Warnings) != 1 || result.Warnings[0].Field != "legs.1.remark" {
+		t.Errorf("warnings = %+v, want one for legs.1.remark", result.Warnings)
+	}
+	if len(result.Substitutions) != 2 {
+		t.Errorf("got %d substitutions, want 2", len(result.Substitutions))
+	}
+}
+
+func TestProcessJSONInvalid(t *testing.T) {
+	for _, input := range []string{
+		``,
+		`{"notes": "Fly #HAJ"`,
+		`{"notes": "Fly #HAJ"} {}`,
+		`{"notes": "Fly #HAJ",}`,
+		`Fly #HAJ`,
+	} {
+		_, err := processJSON([]byte(input), testLookup(), testOptions(t, "-json-fields", "notes"))
+		if err == nil || err.Error() != "Input is not valid JSON" {
+			t.Errorf("processJSON(%q) error = %v, want Input is not valid JSON", input, err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// AirportLookup finds airports by their "#IATA" or "##ICAO" code. Each
+// airport is stored once however many codes point at it, and the codes are
+// kept in sorted fixed-size arrays searched with binary search, which for
+// the full world dataset takes far less memory than a map keyed by
+// prefixed code strings.
+type AirportLookup struct {
+	airports []Airport
+	iata     []iataEntry
+	icao     []icaoEntry
+
+	// Codes of the airports -countries left out, sorted, so tokens for
+	// them can be told apart from codes the lookup doesn't have at all
+	filteredIATA [][3]byte
+	filteredICAO [][4]byte
+}
+
+type iataEntry struct {
+	code  [3]byte
+	index int32 // into airports
+}
+
+type icaoEntry struct {
+	code  [4]byte
+	index int32
+}
+
+// Index the airports. Codes of a disabled family are left out. When two
+// airports share a code the later one wins.
+func newAirportLookup(airports []Airport, withIATA, withICAO bool) *AirportLookup {
+	l := &AirportLookup{airports: airports}
+	for i, airport := range airports {
+		if withIATA && len(airport.IATA) == 3 {
+			var e iataEntry
+			copy(e.code[:], airport.IATA)
+			e.index = int32(i)
+			l.iata = append(l.iata, e)
+		}
+		if withICAO && len(airport.ICAO) == 4 {
+			var e icaoEntry
+			copy(e.code[:], airport.ICAO)
+			e.index = int32(i)
+			l.icao = append(l.icao, e)
+		}
+	}
+
+	// Sort by code, later rows first, then keep the first of each code
+	sort.SliceStable(l.iata, func(i, j int) bool {
+		if l.iata[i].code != l.iata[j].code {
+			return string(l.iata[i].code[:]) < string(l.iata[j].code[:])
+		}
+		return l.iata[i].index > l.iata[j].index
+	})
+	l.iata = dedupeCodes(l.iata, func(e iataEntry) [3]byte { return e.code })
+	sort.SliceStable(l.icao, func(i, j int) bool {
+		if l.icao[i].code != l.icao[j].code {
+			return string(l.icao[i].code[:]) < string(l.icao[j].code[:])
+		}
+		return l.icao[i].index > l.icao[j].index
+	})
+	l.icao = dedupeCodes(l.icao, func(e icaoEntry) [4]byte { return e.code })
+	return l
+}
+
+// Drop entries repeating the code of the entry before them
+func dedupeCodes[E any, C comparable](entries []E, code func(E) C) []E {
+	out := entries[:0]
+	for i, e := range entries {
+		if i == 0 || code(e) != code(entries[i-1]) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Find the index of the airport with the given "#IATA" or "##ICAO" code
+func (l *AirportLookup) find(code string) (int, bool) {
+	if strings.HasPrefix(code, "##") && len(code) == 6 {
+		var key [4]byte
+		copy(key[:], code[2:])
+		i := sort.Search(len(l.icao), func(i int) bool { return string(l.icao[i].code[:]) >= string(key[:]) })
+		if i < len(l.icao) && l.icao[i].code == key {
+			return int(l.icao[i].index), true
+		}
+		return 0, false
+	}
+	if strings.HasPrefix(code, "#") && len(code) == 4 {
+		var key [3]byte
+		copy(key[:], code[1:])
+		i := sort.Search(len(l.iata), func(i int) bool { return string(l.iata[i].code[:]) >= string(key[:]) })
+		if i < len(l.iata) && l.iata[i].code == key {
+			return int(l.iata[i].index), true
+		}
+	}
+	return 0, false
+}
+
+// Remember the codes of airports left out of the lookup
+func (l *AirportLookup) setFiltered(airports []Airport) {
+	for _, airport := range airports {
+		if len(airport.IATA) == 3 {
+			l.filteredIATA = append(l.filteredIATA, [3]byte([]byte(airport.IATA)))
+		}
+		if len(airport.ICAO) == 4 {
+			l.filteredICAO = append(l.filteredICAO, [4]byte([]byte(airport.ICAO)))
+		}
+	}
+	sort.Slice(l.filteredIATA, func(i, j int) bool {
+		return string(l.filteredIATA[i][:]) < string(l.filteredIATA[j][:])
+	})
+	sort.Slice(l.filteredICAO, func(i, j int) bool {
+		return string(l.filteredICAO[i][:]) < string(l.filteredICAO[j][:])
+	})
+}
+
+// Report whether the "#IATA" or "##ICAO" code belongs to an airport that
+// -countries left out
+func (l *AirportLookup) filteredOut(code string) bool {
+	if strings.HasPrefix(code, "##") && len(code) == 6 {
+		key := code[2:]
+		i := sort.Search(len(l.filteredICAO), func(i int) bool { return string(l.filteredICAO[i][:]) >= key })
+		return i < len(l.filteredICAO) && string(l.filteredICAO[i][:]) == key
+	}
+	if strings.HasPrefix(code, "#") && len(code) == 4 {
+		key := code[1:]
+		i := sort.Search(len(l.filteredIATA), func(i int) bool { return string(l.filteredIATA[i][:]) >= key })
+		return i < len(l.filteredIATA) && string(l.filteredIATA[i][:]) == key
+	}
+	return false
+}
+
+// Get the airport with the given "#IATA" or "##ICAO" code
+func (l *AirportLookup) Get(code string) (Airport, bool) {
+	i, ok := l.find(code)
+	if !ok {
+		return Airport{}, false
+	}
+	return l.airports[i], true
+}
+
+// Len returns the number of airports
+func (l *AirportLookup) Len() int {
+	return len(l.airports)
+}
+
+// Codes returns every code in the lookup with its # or ## prefix, sorted
+func (l *AirportLookup) Codes() []string {
+	codes := make([]string, 0, len(l.iata)+len(l.icao))
+	for _, e := range l.icao {
+		codes = append(codes, "##"+string(e.code[:]))
+	}
+	for _, e := range l.iata {
+		codes = append(codes, "#"+string(e.code[:]))
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Change the display name of the airport with the given code, which is
+// seen under all of its codes. Reports whether the code was found.
+func (l *AirportLookup) rename(code, name, source string) bool {
+	i, ok := l.find(code)
+	if !ok {
+		return false
+	}
+	l.airports[i].Name = name
+	l.airports[i].NameSource = source
+	return true
+}
+
+// Hands out one shared copy of each distinct string, so the thousands of
+// repeated country and city values don't each keep their own copy (or the
+// whole CSV record they were sliced from) alive
+type interner map[string]string
+
+func (in interner) intern(s string) string {
+	if shared, ok := in[s]; ok {
+		return shared
+	}
+	s = strings.Clone(s)
+	in[s] = s
+	return s
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+// Load the bundled lookup, skipping the benchmark when it is missing
+func benchmarkAirports(b *testing.B) (*AirportLookup, []string) {
+	airportLookup, _, err := parseAirportLookup(localStorage{}, "airport-lookup.csv", nil, false)
+	if err != nil {
+		b.Skip("airport-lookup.csv not available:", err)
+	}
+	return airportLookup, airportLookup.Codes()
+}
+
+// The map keyed by prefixed codes that AirportLookup replaced
+func mapLookup(airportLookup *AirportLookup) map[string]Airport {
+	m := make(map[string]Airport)
+	for _, airport := range airportLookup.airports {
+		m["##"+airport.ICAO] = airport
+		m["#"+airport.IATA] = airport
+	}
+	return m
+}
+
+func BenchmarkParseAirportLookup(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := parseAirportLookup(localStorage{}, "airport-lookup.csv", nil, false); err != nil {
+			b.Skip("airport-lookup.csv not available:", err)
+		}
+	}
+}
+
+func BenchmarkNewAirportLookup(b *testing.B) {
+	airportLookup, _ := benchmarkAirports(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newAirportLookup(airportLookup.airports, true, true)
+	}
+}
+
+func BenchmarkNewMapLookup(b *testing.B) {
+	airportLookup, _ := benchmarkAirports(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mapLookup(airportLookup)
+	}
+}
+
+func BenchmarkAirportLookupGet(b *testing.B) {
+	airportLookup, codes := benchmarkAirports(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		airportLookup.Get(codes[i%len(codes)])
+	}
+}
+
+func BenchmarkMapLookupGet(b *testing.B) {
+	airportLookup, codes := benchmarkAirports(b)
+	m := mapLookup(airportLookup)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = m[codes[i%len(codes)]]
+	}
+}
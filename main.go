@@ -1,207 +1,1225 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
 func main() {
-	// Command-line flag
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "test-corpus":
+			os.Exit(runTestCorpus(os.Args[2:]))
+		case "gen-sample":
+			os.Exit(runGenSample(os.Args[2:]))
+		case "analyze":
+			os.Exit(runAnalyze(os.Args[2:]))
+		case "decrypt":
+			os.Exit(runDecrypt(os.Args[2:]))
+		case "preflight":
+			os.Exit(runPreflight(os.Args[2:]))
+		}
+	}
+
+	// Command-line flags
 	helpFlag := flag.Bool("h", false, "Display help")
+	readOptions := optionFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *helpFlag {
-		fmt.Println("Itinerary usage:\n go run . ./input.txt ./output.txt ./airport-lookup.csv")
+		fmt.Println("Itinerary usage:\n go run . [options] ./input.txt ./output.txt ./airport-lookup.csv")
+		fmt.Println(" go run . test-corpus [options] ./corpus ./airport-lookup.csv")
+		fmt.Println(" go run . gen-sample [-seed N] [-lines N] [-density F] ./airport-lookup.csv ./sample.txt")
+		fmt.Println(" go run . analyze [options] [-json stats.json] ./airport-lookup.csv ./docs...")
+		fmt.Println(" go run . decrypt -key-file ./passphrase.txt ./output.enc ./output.txt")
+		fmt.Println(" go run . preflight [options] ./input.txt ./output.txt ./airport-lookup.csv")
+		flag.PrintDefaults()
 		return
 	}
 
+	// Usage errors exit 2, like the subcommands, so pipelines see them
+	opts, err := readOptions()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
 	// Validate arguments
 	args := flag.Args()
 	if len(args) != 3 {
 		fmt.Println("Incorrect number of arguments")
 		fmt.Println("Itinerary usage:\n go run . ./input.txt ./output.txt ./airport-lookup.csv")
-		return
+		os.Exit(2)
 	}
 
 	inputFile, outputFile, lookupFile := args[0], args[1], args[2]
 
 	// Process itinerary
-	err := processItinerary(inputFile, outputFile, lookupFile)
+	err = processItinerary(newStorage(opts.http), inputFile, outputFile, lookupFile, opts)
 	if err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
 	}
 }
 
-// Function to process the itinerary
-func processItinerary(inputFile, outputFile, lookupFile string) error {
+// Options collected from command-line flags
+type options struct {
+	mkdirs   bool        // create missing output directories
+	dirMode  os.FileMode // permissions for created directories
+	nameCase string      // as-is, title or upper
+	redact   bool        // mask personal references
+	locale   string      // key into numberFormats
+
+	bagPhrasesFile string            // optional baggage phrase overrides
+	bagPhrases     map[string]string // phrase table used for BAG tokens
+	seatLayout     string            // e.g. "ABC-DEF", see seatPosition
+	headline       bool              // prepend buildHeadline output
+	noTokens       string            // ignore, warn or error when the input has no tokens
+	countries      map[string]bool   // keep only airports in these countries, all when empty
+	hideOffset     bool              // leave the UTC offset out of T12/T24 times
+	snippetFiles   []string          // files appended after processing, in order
+	snippets       []string          // contents of snippetFiles
+	provenance     bool              // start the output with a provenanceHeader
+	processedInput string            // error or warn when the input has a provenance header
+	overridesFile  string            // optional display name overrides
+	context        string            // selects context-scoped overrides
+	offMarker      string            // start of a region left unprocessed
+	onMarker       string            // end of that region
+	explainFile    string            // where to write why each substitution happened
+	sourceMapFile  string            // where to write the output-to-input source map
+	postProcessors []string          // names of the post-processors, in run order
+	partialLookup  bool              // use the valid half of a lookup with a broken code column
+	encryptKeyFile string            // passphrase file; when set every written file is encrypted
+	metrosFile     string            // optional metro area groupings for the headline
+	metros         map[string]string // code to metro name, from metrosFile
+	airlinesFile   string            // optional airlines for checking flight numbers
+	airlines       map[string]string // carrier code to airline name, nil when not checking
+	profileName    string            // name of the profile for D, T12 and T24 tokens
+	profilesFile   string            // optional extra time profiles
+	timeProfile    timeProfile       // the profile in use
+	jsonFields     []string          // treat the input as JSON and process only these fields
+	http           httpSettings      // for files given as http(s) URLs
+}
+
+// Flag value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Register the processing flags on a flag set. The returned function
+// validates the parsed values and builds the options from them.
+func optionFlags(fs *flag.FlagSet) func() (options, error) {
+	mkdirsFlag := fs.Bool("mkdirs", false, "Create missing directories for the output, -explain and -source-map files")
+	dirModeFlag := fs.String("dir-mode", "0755", "Permissions for directories created by -mkdirs")
+	nameCaseFlag := fs.String("name-case", "as-is", "Casing of airport names: as-is, title or upper")
+	redactFlag := fs.Bool("redact", false, "Mask booking references and ticket numbers")
+	localeFlag := fs.String("locale", "en", "Locale for amounts: en, de, fr or et")
+	bagPhrasesFlag := fs.String("bag-phrases", "", "CSV file overriding the baggage phrases")
+	seatLayoutFlag := fs.String("seat-layout", "ABC-DEF", "Seat letters of one row, aisles marked with -")
+	headlineFlag := fs.Bool("headline", false, "Insert a route and date headline at the top")
+	noTokensFlag := fs.String("no-tokens", "ignore", "What to do when the input has no tokens: ignore, warn or error")
+	hideOffsetFlag := fs.Bool("hide-offset", false, "Print T12/T24 times without the UTC offset")
+	var snippetFlags stringList
+	fs.Var(&snippetFlags, "append-snippet", "File appended to the output, can be repeated")
+	provenanceFlag := fs.Bool("provenance", false, "Start the output with a provenance comment")
+	processedInputFlag := fs.String("processed-input", "error", "What to do when the input is a previous output: error or warn")
+	overridesFlag := fs.String("overrides", "", "CSV file with code,name,context airport name overrides")
+	contextFlag := fs.String("context", "", "Document context (locale or tenant) used to pick overrides")
+	offMarkerFlag := fs.String("off-marker", "<!-- airportcodes:off -->", "Marker that turns processing off")
+	onMarkerFlag := fs.String("on-marker", "<!-- airportcodes:on -->", "Marker that turns processing back on")
+	explainFlag := fs.String("explain", "", "Write why each substitution happened to this file")
+	postProcessFlag := fs.String("post-process", strings.Join(defaultPostProcessors, ","), "Order of the post-processing steps")
+	partialLookupFlag := fs.Bool("partial-lookup", false, "Use a lookup with a broken ICAO or IATA column, disabling those codes")
+	sourceMapFlag := fs.String("source-map", "", "Write a JSON source map of all substitutions to this file")
+	encryptKeyFlag := fs.String("encrypt-key-file", "", "Encrypt the output (and sidecar files) with the passphrase in this file")
+	metrosFlag := fs.String("metros", "", "CSV file with code,metro groupings used in the headline")
+	airlinesFlag := fs.String("airlines", "", "CSV file with code,name airlines; flight numbers of other carriers are flagged")
+	timeProfileFlag := fs.String("time-profile", "default", "How D, T12 and T24 tokens are read and written: default, gds or iso-strict")
+	timeProfilesFlag := fs.String("time-profiles", "", "CSV file with name,field,value defining more time profiles")
+	jsonFieldsFlag := fs.String("json-fields", "", "Treat the input as JSON and process only these comma-separated fields, e.g. notes,legs.*.remark")
+	httpFlag := httpFlags(fs)
+	countriesFlag := fs.String("countries", "", "Comma-separated country codes to load from the lookup, e.g. EE,FI,DE")
+
+	return func() (options, error) {
+		// Collect every problem so they can all be fixed in one go
+		var errs []error
+
+		dirMode, err := strconv.ParseUint(*dirModeFlag, 8, 32)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Invalid directory mode"))
+		}
+
+		if *nameCaseFlag != "as-is" && *nameCaseFlag != "title" && *nameCaseFlag != "upper" {
+			errs = append(errs, fmt.Errorf("Invalid name case"))
+		}
+
+		if _, ok := numberFormats[*localeFlag]; !ok {
+			errs = append(errs, fmt.Errorf("Invalid locale"))
+		}
+
+		if !regexp.MustCompile(`^[A-Z]+(-[A-Z]+)*$`).MatchString(*seatLayoutFlag) {
+			errs = append(errs, fmt.Errorf("Invalid seat layout"))
+		}
+
+		if *noTokensFlag != "ignore" && *noTokensFlag != "warn" && *noTokensFlag != "error" {
+			errs = append(errs, fmt.Errorf("Invalid no-tokens mode"))
+		}
+
+		if *processedInputFlag != "error" && *processedInputFlag != "warn" {
+			errs = append(errs, fmt.Errorf("Invalid processed-input mode"))
+		}
+
+		postProcessors := strings.Split(*postProcessFlag, ",")
+		for i, name := range postProcessors {
+			if slices.Contains(postProcessors[:i], name) {
+				errs = append(errs, fmt.Errorf("Post-processor %q given more than once", name))
+				continue
+			}
+			if slices.Contains(defaultPostProcessors, name) {
+				continue
+			}
+			if guess, ok := suggest(name, defaultPostProcessors); ok {
+				errs = append(errs, fmt.Errorf("Invalid post-processor %q, did you mean %q?", name, guess))
+			} else {
+				errs = append(errs, fmt.Errorf("Invalid post-processor %q", name))
+			}
+		}
+
+		// A step left out of -post-process would silently drop its output
+		if *headlineFlag && !slices.Contains(postProcessors, "headline") {
+			errs = append(errs, fmt.Errorf("-headline needs the headline post-processor"))
+		}
+		if len(snippetFlags) > 0 && !slices.Contains(postProcessors, "snippets") {
+			errs = append(errs, fmt.Errorf("-append-snippet needs the snippets post-processor"))
+		}
+
+		countries := make(map[string]bool)
+		if *countriesFlag != "" {
+			for _, country := range strings.Split(*countriesFlag, ",") {
+				country = strings.ToUpper(strings.TrimSpace(country))
+				if !regexp.MustCompile(`^[A-Z]{2}$`).MatchString(country) {
+					errs = append(errs, fmt.Errorf("Invalid country code %q", country))
+				}
+				countries[country] = true
+			}
+		}
+
+		// Profiles from -time-profiles are only known once the file is loaded
+		timeProfile, err := selectTimeProfile(timeProfiles, *timeProfileFlag)
+		if err != nil && *timeProfilesFlag == "" {
+			errs = append(errs, err)
+		}
+
+		// Headlines, snippets and the sidecar files are about plain text
+		var jsonFields []string
+		if *jsonFieldsFlag != "" {
+			jsonFields = strings.Split(*jsonFieldsFlag, ",")
+			if *headlineFlag || len(snippetFlags) > 0 || *provenanceFlag || *explainFlag != "" || *sourceMapFlag != "" {
+				errs = append(errs, fmt.Errorf("-json-fields can't be combined with -headline, -append-snippet, -provenance, -explain or -source-map"))
+			}
+		}
+
+		if len(errs) > 0 {
+			return options{}, errors.Join(errs...)
+		}
+
+		return options{
+			mkdirs:   *mkdirsFlag,
+			dirMode:  os.FileMode(dirMode),
+			nameCase: *nameCaseFlag,
+			redact:   *redactFlag,
+			locale:   *localeFlag,
+
+			bagPhrasesFile: *bagPhrasesFlag,
+			seatLayout:     *seatLayoutFlag,
+			headline:       *headlineFlag,
+			noTokens:       *noTokensFlag,
+			countries:      countries,
+			hideOffset:     *hideOffsetFlag,
+			snippetFiles:   snippetFlags,
+			provenance:     *provenanceFlag,
+			processedInput: *processedInputFlag,
+			overridesFile:  *overridesFlag,
+			context:        *contextFlag,
+			offMarker:      *offMarkerFlag,
+			onMarker:       *onMarkerFlag,
+			explainFile:    *explainFlag,
+			sourceMapFile:  *sourceMapFlag,
+			postProcessors: postProcessors,
+			partialLookup:  *partialLookupFlag,
+			encryptKeyFile: *encryptKeyFlag,
+			metrosFile:     *metrosFlag,
+			airlinesFile:   *airlinesFlag,
+			profileName:    *timeProfileFlag,
+			profilesFile:   *timeProfilesFlag,
+			timeProfile:    timeProfile,
+			jsonFields:     jsonFields,
+			http:           *httpFlag,
+		}, nil
+	}
+}
+
+// Load the airport lookup and the other data files the options refer to
+func loadResources(store Storage, lookupFile string, opts options) (*AirportLookup, options, error) {
 	// Read and parse airport lookup
-	airportLookup, err := parseAirportLookup(lookupFile)
+	// Load every data file, collecting the problems of all of them
+	var errs []error
+
+	// Read and parse airport lookup
+	airportLookup, notes, err := parseAirportLookup(store, lookupFile, opts.countries, opts.partialLookup)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, note := range notes {
+		fmt.Println("Warning:", note)
+	}
+
+	// Apply display name overrides on top of the lookup
+	if opts.overridesFile != "" {
+		overrides, err := loadOverrides(store, opts.overridesFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if airportLookup != nil {
+			applyOverrides(airportLookup, overrides, opts.context)
+		}
+	}
+
+	// Load baggage phrases
+	opts.bagPhrases, err = loadBagPhrases(store, opts.bagPhrasesFile)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// Load metro groupings for the headline
+	if opts.metrosFile != "" {
+		opts.metros, err = loadMetros(store, opts.metrosFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Load airlines to check flight numbers against
+	if opts.airlinesFile != "" {
+		opts.airlines, err = loadAirlines(store, opts.airlinesFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Load extra time profiles and pick the one to use
+	if opts.profilesFile != "" {
+		profiles, err := loadTimeProfiles(store, opts.profilesFile)
+		if err != nil {
+			errs = append(errs, err)
+		} else if opts.timeProfile, err = selectTimeProfile(profiles, opts.profileName); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Load snippets to append
+	opts.snippets = nil
+	for _, snippetFile := range opts.snippetFiles {
+		snippet, err := store.ReadFile(snippetFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Snippet %s not found", snippetFile))
+		}
+		opts.snippets = append(opts.snippets, string(snippet))
+	}
+
+	if len(errs) > 0 {
+		return nil, opts, errors.Join(errs...)
+	}
+	return airportLookup, opts, nil
+}
+
+// Function to process the itinerary
+func processItinerary(store Storage, inputFile, outputFile, lookupFile string, opts options) error {
+	// Read airport lookup and other data files
+	airportLookup, opts, err := loadResources(store, lookupFile, opts)
 	if err != nil {
 		return err
 	}
 
 	//Read input file
-	input, err := os.ReadFile(inputFile)
+	input, err := store.ReadFile(inputFile)
 	if err != nil {
 		return fmt.Errorf("Input not found")
 	}
 
-	//Process text
-	processedText := processText(string(input), airportLookup)
+	// Processing an output again mangles the already formatted text
+	if strings.HasPrefix(string(input), provenancePrefix) {
+		if opts.processedInput == "error" {
+			return fmt.Errorf("Input is already a processed output")
+		}
+		fmt.Println("Warning: Input is already a processed output")
+	}
+
+	//Process text, or only the chosen fields of a JSON input
+	var result processResult
+	if len(opts.jsonFields) > 0 {
+		result, err = processJSON(input, airportLookup, opts)
+		if err != nil {
+			return err
+		}
+	} else {
+		result = processText(string(input), airportLookup, opts)
+	}
+	for _, warning := range result.Warnings {
+		fmt.Println("Warning:", warning)
+	}
+
+	// Empty input or input without tokens is a successful no-op unless
+	// asked to flag it. Line-break escapes don't count, nor do tokens in
+	// protected regions or in JSON fields that weren't selected.
+	if !hasTokens(result.Substitutions) {
+		switch opts.noTokens {
+		case "warn":
+			fmt.Println("Warning: No tokens found in input")
+		case "error":
+			return fmt.Errorf("No tokens found in input")
+		}
+	}
+	processedText := result.Text
+	if opts.provenance {
+		header := provenanceHeader(input) + "\n"
+		processedText = header + processedText
+		for i := range result.Substitutions {
+			if sub := &result.Substitutions[i]; sub.OutputStart >= 0 {
+				sub.OutputStart += len(header)
+				sub.OutputEnd += len(header)
+			}
+		}
+	}
+
+	// Encrypt everything written from here on
+	if opts.encryptKeyFile != "" {
+		passphrase, err := loadPassphrase(store, opts.encryptKeyFile)
+		if err != nil {
+			return err
+		}
+		store = encryptingStorage{Storage: store, passphrase: passphrase}
+	}
+
+	// Create output directories if asked to
+	if opts.mkdirs {
+		for _, file := range []string{outputFile, opts.explainFile, opts.sourceMapFile} {
+			if file == "" {
+				continue
+			}
+			err = store.MkdirAll(filepath.Dir(file), opts.dirMode)
+			if err != nil {
+				return fmt.Errorf("Error creating output directory")
+			}
+		}
+	}
 
 	// Write to output file
-	err = os.WriteFile(outputFile, []byte(processedText), 0644)
+	err = store.WriteFile(outputFile, []byte(processedText))
 	if err != nil {
 		return fmt.Errorf("Error writing to output file")
 	}
 
+	// Write the explanation of every substitution
+	if opts.explainFile != "" {
+		err = store.WriteFile(opts.explainFile, []byte(formatExplanation(result.Substitutions)))
+		if err != nil {
+			return fmt.Errorf("Error writing to explain file")
+		}
+	}
+
+	// Write the source map
+	if opts.sourceMapFile != "" {
+		sourceMap, err := buildSourceMap(inputFile, outputFile, result)
+		if err != nil {
+			return err
+		}
+		err = store.WriteFile(opts.sourceMapFile, sourceMap)
+		if err != nil {
+			return fmt.Errorf("Error writing to source map file")
+		}
+	}
+
 	return nil
 }
 
-func parseAirportLookup(filepath string) (map[string]string, error) {
-	// Open file
-	file, err := os.Open(filepath)
+// Airport is a single row of the airport lookup
+type Airport struct {
+	Name           string
+	Country        string
+	Municipality   string
+	ICAO           string
+	IATA           string
+	Latitude       float64 // degrees, only meaningful when HasCoordinates is set
+	Longitude      float64
+	HasCoordinates bool
+	Elevation      float64 // feet, only meaningful when HasElevation is set
+	HasElevation   bool
+	Line           int    // line in the lookup file
+	NameSource     string // where Name came from when it isn't the lookup
+}
+
+// Parse the lookup CSV. When countries is not empty only airports in those
+// countries are kept. With partial set, a broken ICAO or IATA column only
+// disables that code family; the returned notes say which one.
+func parseAirportLookup(store Storage, filepath string, countries map[string]bool, partial bool) (*AirportLookup, []string, error) {
+	// Read file
+	data, err := store.ReadFile(filepath)
 	if err != nil {
-		return nil, fmt.Errorf("Airport lookup not found")
+		return nil, nil, fmt.Errorf("Airport lookup not found")
 	}
-	defer file.Close()
 
-	// Read .csv content
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		return nil, fmt.Errorf("Airport lookup malformed")
+	problems := &dataProblems{what: "Airport lookup"}
+
+	// Read .csv content, noting every bad row
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	var records []dataRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			problems.add(parseErr.Line, "%v", parseErr.Err)
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		records = append(records, dataRow{line: line, fields: record})
+	}
+
+	// Elevation is an optional seventh column
+	columns := 6
+	if len(records) > 0 && len(records[0].fields) == 7 && records[0].fields[6] == "elevation_ft" {
+		columns = 7
 	}
 
 	// Process records
-	lookup := make(map[string]string)
-	for i, record := range records {
+	var airports, filtered []Airport
+	strs := make(interner)
+	badICAO, badIATA := 0, 0 // first lookup line with a broken code
+	for i, row := range records {
 		if i == 0 { // Skip header row
 			continue
 		}
-		if len(record) != 6 || record[0] == "" || record[3] == "" || record[4] == "" {
-			return nil, fmt.Errorf("Airport lookup malformed")
+		record, line := row.fields, row.line
+		if len(record) != columns {
+			problems.add(line, "expected %d fields, got %d", columns, len(record))
+			continue
+		}
+		if record[0] == "" {
+			problems.add(line, "airport name is empty")
+			continue
+		}
+		if !partial && (record[3] == "" || record[4] == "") {
+			problems.add(line, "ICAO and IATA codes are both required")
+			continue
+		}
+		if badICAO == 0 && (len(record[3]) != 4 || !isCode(record[3], 4)) {
+			badICAO = line
+		}
+		if badIATA == 0 && (len(record[4]) != 3 || !isCode(record[4], 3)) {
+			badIATA = line
+		}
+		if len(countries) > 0 && !countries[record[1]] {
+			filtered = append(filtered, Airport{ICAO: record[3], IATA: record[4]})
+			continue
+		}
+
+		airport := Airport{
+			Name:         strings.Clone(record[0]),
+			Country:      strs.intern(record[1]),
+			Municipality: strs.intern(record[2]),
+			ICAO:         strings.Clone(record[3]),
+			IATA:         strings.Clone(record[4]),
+			Line:         line,
+		}
+		// Missing or unreadable coordinates only leave the airport without
+		// them; nothing needs them to replace codes
+		if lon, lat, err := parseCoordinates(record[5]); err == nil {
+			airport.Longitude, airport.Latitude, airport.HasCoordinates = lon, lat, true
+		}
+		if columns == 7 && record[6] != "" {
+			airport.Elevation, err = strconv.ParseFloat(record[6], 64)
+			if err != nil {
+				problems.add(line, "elevation %q is not a number", record[6])
+				continue
+			}
+			airport.HasElevation = true
+		}
+		airports = append(airports, airport)
+	}
+
+	// Only one broken code family can be worked around
+	var notes []string
+	if partial {
+		if badICAO != 0 && badIATA != 0 {
+			problems.add(max(badICAO, badIATA), "invalid ICAO code on line %d and IATA code on line %d; only one family can be disabled", badICAO, badIATA)
+		}
+		if badICAO != 0 {
+			notes = append(notes, fmt.Sprintf("ICAO codes (##) disabled: invalid code on lookup line %d", badICAO))
+		}
+		if badIATA != 0 {
+			notes = append(notes, fmt.Sprintf("IATA codes (#) disabled: invalid code on lookup line %d", badIATA))
+		}
+	}
+	if err := problems.err(); err != nil {
+		return nil, nil, err
+	}
+
+	// Index both IATA and ICAO codes
+	lookup := newAirportLookup(airports, !partial || badIATA == 0, !partial || badICAO == 0)
+	lookup.setFiltered(filtered)
+
+	return lookup, notes, nil
+}
+
+// Parse the "longitude, latitude" coordinates column
+func parseCoordinates(coordinates string) (float64, float64, error) {
+	parts := strings.Split(coordinates, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid coordinates %q", coordinates)
+	}
+	longitude, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	latitude, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return longitude, latitude, nil
+}
+
+// Result of processing a text
+type processResult struct {
+	Text          string
+	Warnings      []Warning      // non-fatal problems found on the way
+	Substitutions []Substitution // every token and what was done with it
+}
+
+// Report whether any of the substitutions is for a token other than a
+// line-break escape
+func hasTokens(substitutions []Substitution) bool {
+	for _, sub := range substitutions {
+		if sub.kind != tokenLineBreak {
+			return true
+		}
+	}
+	return false
+}
+
+// Process the text
+func processText(text string, airportLookup *AirportLookup, opts options) processResult {
+	result, _ := processTextBefore(text, airportLookup, opts, time.Time{})
+	return result
+}
+
+// processText, giving up with false once the deadline has passed (never
+// when it is zero). The token scan checks the deadline as it goes and it
+// is checked again around each post-processor, so a huge document stops
+// part way instead of running to the end.
+func processTextBefore(text string, airportLookup *AirportLookup, opts options, deadline time.Time) (processResult, bool) {
+	segments := splitProtected(text, opts.offMarker, opts.onMarker)
+
+	// Build the headline while the codes are still in the text
+	headline := ""
+	if opts.headline {
+		var unprotected strings.Builder
+		for _, seg := range segments {
+			if !seg.protected {
+				unprotected.WriteString(text[seg.start:seg.end])
+			}
+		}
+		headline = buildHeadline(unprotected.String(), airportLookup, opts.metros, opts.timeProfile)
+		if pastDeadline(deadline) {
+			return processResult{}, false
+		}
+	}
+
+	// Replace tokens outside protected regions. The regions are stood in
+	// for by placeholders until the post-processors are done, so steps such
+	// as blank-lines can't change them.
+	var b strings.Builder
+	var result processResult
+	var protected []string
+	lines := lineCounter{line: 1}
+	for _, seg := range segments {
+		if seg.protected {
+			b.WriteString(protectedPlaceholder(len(protected)))
+			protected = append(protected, text[seg.start:seg.end])
+			continue
+		}
+		if !replaceTokens(&b, text, seg.start, seg.end, airportLookup, opts, &result, &lines, deadline) {
+			return processResult{}, false
+		}
+	}
+	text = b.String()
+
+	// Output offsets are only kept for the source map. They are in text
+	// order, start and end of each substitution in turn.
+	var offsets []int
+	if opts.sourceMapFile != "" {
+		offsets = make([]int, 0, 2*len(result.Substitutions))
+		for _, sub := range result.Substitutions {
+			offsets = append(offsets, sub.OutputStart, sub.OutputEnd)
+		}
+	}
+
+	// Run the post-processors in the configured order, keeping the offsets
+	// in step with the text until a step can't say where they went
+	for _, name := range opts.postProcessors {
+		if pastDeadline(deadline) {
+			return processResult{}, false
+		}
+		step := newPostProcessor(name, headline, opts)
+		if mapper, ok := step.(OffsetMapper); ok {
+			mapper.MapOffsets(text, offsets)
+		} else {
+			offsets = nil
 		}
+		text = step.Process(text)
+	}
+	if pastDeadline(deadline) {
+		return processResult{}, false
+	}
+	result.Text = restoreProtected(text, protected, offsets)
 
-		// Map both IATA and ICAO codes to the airport name
-		lookup["#"+record[4]] = record[0]  // IATA
-		lookup["##"+record[3]] = record[0] // ICAO
+	for i := range result.Substitutions {
+		sub := &result.Substitutions[i]
+		if offsets == nil {
+			sub.OutputStart, sub.OutputEnd = -1, -1
+		} else {
+			sub.OutputStart, sub.OutputEnd = offsets[2*i], offsets[2*i+1]
+		}
 	}
+	return result, true
+}
 
-	return lookup, nil
+// Stand-in for the i-th protected region while post-processing
+func protectedPlaceholder(i int) string {
+	return "\x00protected:" + strconv.Itoa(i) + "\x00"
 }
 
-func processText(text string, airportLookup map[string]string) string {
-	// Replace airport codes
-	for code, name := range airportLookup {
-		text = strings.ReplaceAll(text, code, name)
+// Put the protected regions back in place of their placeholders, moving
+// the sorted output offsets after each one to match
+func restoreProtected(text string, protected []string, offsets []int) string {
+	var b strings.Builder
+	last, next, shift := 0, 0, 0
+	for i, region := range protected {
+		placeholder := protectedPlaceholder(i)
+		at := strings.Index(text[last:], placeholder)
+		if at < 0 {
+			continue
+		}
+		b.WriteString(text[last : last+at])
+		b.WriteString(region)
+		last += at + len(placeholder)
+
+		for ; next < len(offsets) && offsets[next] < last; next++ {
+			offsets[next] += shift
+		}
+		shift += len(region) - len(placeholder)
 	}
+	b.WriteString(text[last:])
+	for ; next < len(offsets); next++ {
+		offsets[next] += shift
+	}
+	return b.String()
+}
 
-	// Replace D dates from the first code
-	text = regexp.MustCompile(`D\(([^)]+)\)`).ReplaceAllStringFunc(text, func(match string) string {
-		dateString := match[2 : len(match)-1]
-		date, err := time.Parse("2006-01-02T15:04-07:00", dateString)
-		if err != nil {
-			date, err = time.Parse("2006-01-02T15:04Z", dateString)
-			if err != nil {
-				return match
+// Report whether a deadline is set and has passed
+func pastDeadline(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+// Run processText, giving up after timeout (no limit when zero) so one
+// pathological document can't stall a whole batch
+func processTextWithin(timeout time.Duration, text string, airportLookup *AirportLookup, opts options) (processResult, bool) {
+	if timeout <= 0 {
+		return processText(text, airportLookup, opts), true
+	}
+	return processTextBefore(text, airportLookup, opts, time.Now().Add(timeout))
+}
+
+// Counts lines as offsets move forward through a text, so numbering every
+// token costs one pass over the text instead of one per token
+type lineCounter struct {
+	pos  int // offset counted up to
+	line int // 1-based line at pos
+}
+
+// Line of the given offset, which must not be before the previous one
+func (c *lineCounter) at(text string, offset int) int {
+	c.line += strings.Count(text[c.pos:offset], "\n")
+	c.pos = offset
+	return c.line
+}
+
+// Replace all tokens in text[start:end] in a single pass, writing to b and
+// recording warnings and substitutions in result. Reports false when the
+// deadline passed first.
+func replaceTokens(b *strings.Builder, text string, start, end int, airportLookup *AirportLookup, opts options, result *processResult, lines *lineCounter, deadline time.Time) bool {
+	tokens, ok := scanTokensBefore(text[start:end], deadline)
+	if !ok {
+		return false
+	}
+	last := start
+	for i, tok := range tokens {
+		if i%4096 == 0 && pastDeadline(deadline) {
+			return false
+		}
+		tok.start += start
+		tok.end += start
+		b.WriteString(text[last:tok.start])
+		last = tok.end
+
+		outputStart := b.Len()
+		replacement, ok := replaceToken(tok, airportLookup, opts)
+		if ok {
+			b.WriteString(replacement)
+		} else {
+			b.WriteString(text[tok.start:tok.end])
+			// Codes of countries left out with -countries are meant to stay
+			if !airportLookup.filteredOut(text[tok.start:tok.end]) {
+				result.Warnings = append(result.Warnings, tokenWarning(text, tok, lines.at(text, tok.start)))
 			}
 		}
-		return date.Format("02 Jan 2006")
-	})
+		if tok.kind == tokenLineBreak {
+			continue // formatting, not worth explaining
+		}
+		sub := newSubstitution(text, tok, lines.at(text, tok.start), replacement, ok, airportLookup)
+		sub.OutputStart, sub.OutputEnd = outputStart, b.Len()
+		result.Substitutions = append(result.Substitutions, sub)
+	}
+	b.WriteString(text[last:end])
+	return true
+}
 
-	// Replace T12 times from the first code
-	text = regexp.MustCompile(`T12\(([^)]+)\)`).ReplaceAllStringFunc(text, func(match string) string {
-		timeString := match[4 : len(match)-1]
-		t, err := time.Parse("2006-01-02T15:04-07:00", timeString)
-		if err != nil {
-			t, err = time.Parse("2006-01-02T15:04Z", timeString)
-			if err != nil {
-				return match
+// Part of the input, either processed or protected by markers
+type segment struct {
+	start, end int
+	protected  bool
+}
+
+// Split text at the off/on markers. The markers themselves belong to no
+// segment, so they are dropped from the output. An off marker without a
+// matching on marker protects the rest of the text.
+func splitProtected(text, offMarker, onMarker string) []segment {
+	var segments []segment
+	pos := 0
+	for pos < len(text) {
+		off := strings.Index(text[pos:], offMarker)
+		if offMarker == "" || off < 0 {
+			break
+		}
+		segments = append(segments, segment{start: pos, end: pos + off})
+		pos += off + len(offMarker)
+
+		on := strings.Index(text[pos:], onMarker)
+		if onMarker == "" || on < 0 {
+			on = len(text) - pos
+		}
+		segments = append(segments, segment{start: pos, end: pos + on, protected: true})
+		pos = min(pos+on+len(onMarker), len(text))
+	}
+	return append(segments, segment{start: pos, end: len(text)})
+}
+
+// Start of the comment written by -provenance
+const provenancePrefix = "<!-- airport-codes "
+
+// Provenance comment naming the tool version and the input's SHA-256
+func provenanceHeader(input []byte) string {
+	version := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
+	}
+	return fmt.Sprintf("%sversion=%s input-sha256=%x -->", provenancePrefix, version, sha256.Sum256(input))
+}
+
+// Build a "Tallinn → Frankfurt → Los Angeles, 01–05 Mar 2024" headline
+// from the airport codes and D dates in the order they appear
+func buildHeadline(text string, airportLookup *AirportLookup, metros map[string]string, profile timeProfile) string {
+	var cities []string
+	var first, last time.Time
+	for _, tok := range scanTokens(text) {
+		switch tok.kind {
+		case tokenICAO, tokenIATA:
+			airport, ok := airportLookup.Get(text[tok.start:tok.end])
+			if !ok {
+				continue
+			}
+			city := airport.Municipality
+			if metro, ok := airportMetro(airport, metros); ok {
+				city = metro
+			} else if city == "" {
+				city = airport.Name
+			}
+			if len(cities) == 0 || cities[len(cities)-1] != city {
+				cities = append(cities, city)
+			}
+
+		case tokenDate:
+			date, ok := profile.parse(tok.body)
+			if !ok {
+				continue
+			}
+			if first.IsZero() || date.Before(first) {
+				first = date
+			}
+			if last.IsZero() || date.After(last) {
+				last = date
 			}
 		}
-		return t.Format("03:04PM (-07:00)")
-	})
+	}
 
-	// Replace T24 times from the first code
-	text = regexp.MustCompile(`T24\(([^)]+)\)`).ReplaceAllStringFunc(text, func(match string) string {
-		timeString := match[4 : len(match)-1]
-		t, err := time.Parse("2006-01-02T15:04-07:00", timeString)
-		if err != nil {
-			t, err = time.Parse("2006-01-02T15:04Z", timeString)
-			if err != nil {
-				return match
+	headline := strings.Join(cities, " → ")
+	if len(cities) == 3 && cities[0] == cities[2] {
+		headline = cities[0] + " ⇄ " + cities[1] // there and back
+	}
+	if !first.IsZero() {
+		if headline != "" {
+			headline += ", "
+		}
+		headline += formatDateRange(first, last)
+	}
+	return headline
+}
+
+// Format a date range as compactly as the two dates allow
+func formatDateRange(first, last time.Time) string {
+	switch {
+	case first.Format("2006-01-02") == last.Format("2006-01-02"):
+		return first.Format("02 Jan 2006")
+	case first.Year() == last.Year() && first.Month() == last.Month():
+		return first.Format("02") + "–" + last.Format("02 Jan 2006")
+	case first.Year() == last.Year():
+		return first.Format("02 Jan") + " – " + last.Format("02 Jan 2006")
+	}
+	return first.Format("02 Jan 2006") + " – " + last.Format("02 Jan 2006")
+}
+
+// Apply the requested casing to an airport name
+func applyNameCase(name, nameCase string) string {
+	switch nameCase {
+	case "upper":
+		return strings.ToUpper(name)
+	case "title":
+		return toTitleCase(name)
+	}
+	return name
+}
+
+// Upper-case the first letter of every word and lower-case the rest
+func toTitleCase(s string) string {
+	runes := []rune(s)
+	startOfWord := true
+	for i, r := range runes {
+		if unicode.IsLetter(r) {
+			if startOfWord {
+				runes[i] = unicode.ToTitle(r)
+			} else {
+				runes[i] = unicode.ToLower(r)
 			}
+			startOfWord = false
+		} else {
+			startOfWord = !unicode.IsDigit(r) && r != '\''
 		}
-		return t.Format("15:04 (-07:00)")
-	})
+	}
+	return string(runes)
+}
 
-	// Replace line-break characters with \n and remove multiple consecutive blank lines
-	text = strings.Replace(text, "\\v", "\n", -1)
-	text = strings.Replace(text, "\\f", "\n", -1)
-	text = strings.Replace(text, "\\r", "\n", -1)
-	text = regexp.MustCompile(`\n{3,}`).ReplaceAllString(text, "\n\n")
+var (
+	pnrRegex          = regexp.MustCompile(`^[A-Z0-9]{6}$`)
+	ticketNumberRegex = regexp.MustCompile(`^[0-9]{13}$`)
+)
 
-	// // Remove multiple consecutive blank lines
-	text = RemoveExtraNewLines(text)
+// Normalize a booking reference to six upper-case letters and digits
+func normalizePNR(s string) (string, bool) {
+	pnr := strings.ToUpper(stripSeparators(s))
+	if !pnrRegex.MatchString(pnr) {
+		return "", false
+	}
+	return pnr, true
+}
+
+// Normalize a 13-digit ticket number to the "220-1234567890" form
+func normalizeTicketNumber(s string) (string, bool) {
+	digits := stripSeparators(s)
+	if !ticketNumberRegex.MatchString(digits) {
+		return "", false
+	}
+	return digits[:3] + "-" + digits[3:], true
+}
 
-	return text
+// Remove spaces and dashes people put inside references
+func stripSeparators(s string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(s))
 }
 
-func formatDate(input, layout string) string {
-	// Extract the date from the matched string
-	dateStr := strings.TrimPrefix(input, "D(")
-	dateStr = strings.TrimSuffix(dateStr, ")")
+// Keep only the last two characters of a booking reference
+func maskPNR(pnr string) string {
+	return strings.Repeat("*", len(pnr)-2) + pnr[len(pnr)-2:]
+}
+
+// Keep the airline prefix and the last four digits of a ticket number
+func maskTicketNumber(ticket string) string {
+	return ticket[:4] + strings.Repeat("*", len(ticket)-8) + ticket[len(ticket)-4:]
+}
+
+var phoneNumberRegex = regexp.MustCompile(`^[1-9][0-9]{6,14}$`)
+
+// Normalize an international phone number to E.164, e.g. "+3725123456"
+func normalizePhoneNumber(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	case strings.HasPrefix(s, "00"):
+		s = s[2:]
+	default:
+		return "", false // no country code
+	}
+
+	// Drop the usual separators and the trunk "(0)" some numbers carry
+	s = strings.Replace(s, "(0)", "", 1)
+	s = strings.NewReplacer(" ", "", "-", "", ".", "", "/", "", "(", "", ")", "").Replace(s)
+	if !phoneNumberRegex.MatchString(s) {
+		return "", false
+	}
+	return "+" + s, true
+}
+
+// Default phrases for baggage allowances. {n} is the number of pieces and
+// {weight} the weight limit, e.g. "23 kg".
+var defaultBagPhrases = map[string]string{
+	"none":          "no checked bags",
+	"piece":         "1 checked bag",
+	"pieces":        "{n} checked bags",
+	"piece_weight":  "1 checked bag up to {weight}",
+	"pieces_weight": "{n} checked bags up to {weight} each",
+	"weight":        "checked baggage up to {weight} in total",
+}
+
+// Read baggage phrase overrides from a "key,phrase" CSV file
+func loadBagPhrases(store Storage, path string) (map[string]string, error) {
+	phrases := make(map[string]string)
+	for key, phrase := range defaultBagPhrases {
+		phrases[key] = phrase
+	}
+	if path == "" {
+		return phrases, nil
+	}
 
-	// Parse date
-	t, err := time.Parse(time.RFC3339, dateStr)
+	rows, problems, err := readDataCSV(store, path, "Baggage phrases", 2, nil)
 	if err != nil {
-		return input // return original on error
+		return nil, err
+	}
+	for _, row := range rows {
+		key := row.fields[0]
+		if _, ok := defaultBagPhrases[key]; !ok {
+			keys := make([]string, 0, len(defaultBagPhrases))
+			for k := range defaultBagPhrases {
+				keys = append(keys, k)
+			}
+			slices.Sort(keys)
+			if guess, ok := suggest(key, keys); ok {
+				problems.add(row.line, "unknown key %q, did you mean %q?", key, guess)
+			} else {
+				problems.add(row.line, "unknown key %q, must be one of %s", key, strings.Join(keys, ", "))
+			}
+			continue
+		}
+		phrases[key] = row.fields[1]
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return phrases, nil
+}
+
+var baggageRegex = regexp.MustCompile(`^(?:(\d+)PC)?/?(?:(\d+)(KG|LBS?))?$`)
+
+// Expand GDS baggage shorthand such as "1PC/23KG", "2PC" or "30KG"
+func expandBaggage(body string, phrases map[string]string) (string, bool) {
+	parts := baggageRegex.FindStringSubmatch(strings.ToUpper(strings.ReplaceAll(body, " ", "")))
+	if parts == nil || (parts[1] == "" && parts[2] == "") {
+		return "", false
 	}
 
-	// Return formatted date
-	return t.Format(layout)
+	// A zero weight counts as no weight given, and as no bags when there
+	// is no piece count either
+	weight := ""
+	if amount := strings.TrimLeft(parts[2], "0"); amount != "" {
+		unit := "kg"
+		if parts[3] != "KG" {
+			unit = "lb"
+		}
+		weight = amount + " " + unit
+	}
+	pieces := strings.TrimLeft(parts[1], "0")
+
+	var key string
+	switch {
+	case parts[1] == "" && weight != "":
+		key = "weight"
+	case pieces == "":
+		key = "none"
+	case pieces == "1" && weight == "":
+		key = "piece"
+	case pieces == "1":
+		key = "piece_weight"
+	case weight == "":
+		key = "pieces"
+	default:
+		key = "pieces_weight"
+	}
+	return strings.NewReplacer("{n}", pieces, "{weight}", weight).Replace(phrases[key]), true
+}
+
+// Render a seat such as "14A" as "Seat 14A (window)"
+func formatSeat(seat, layout string) string {
+	position := seatPosition(seat[len(seat)-1], layout)
+	if position == "" {
+		return "Seat " + seat
+	}
+	return "Seat " + seat + " (" + position + ")"
 }
 
-func formatTime(input string, is12HourFormat bool) string {
-	// Extract the time part from the matched string
-	timeStr := strings.TrimSuffix(strings.TrimPrefix(input, "T12("), ")")
-	timeStr = strings.TrimSuffix(strings.TrimPrefix(timeStr, "T24("), ")")
+// Work out where a seat letter sits in a row layout such as "ABC-DEF"
+// or "AC-DEFG-HK", where - marks an aisle
+func seatPosition(letter byte, layout string) string {
+	i := strings.IndexByte(layout, letter)
+	switch {
+	case i < 0:
+		return ""
+	case i == 0 || i == len(layout)-1:
+		return "window"
+	case layout[i-1] == '-' || layout[i+1] == '-':
+		return "aisle"
+	}
+	return "middle"
+}
 
-	// Parse time
-	t, err := time.Parse(time.RFC3339, timeStr)
+// Separators and symbol placement used when printing amounts
+type numberFormat struct {
+	thousands     string
+	decimal       string
+	symbolInFront bool
+}
+
+var numberFormats = map[string]numberFormat{
+	"en": {thousands: ",", decimal: ".", symbolInFront: true},
+	"de": {thousands: ".", decimal: ",", symbolInFront: false},
+	"fr": {thousands: "\u202f", decimal: ",", symbolInFront: false},
+	"et": {thousands: "\u00a0", decimal: ",", symbolInFront: false},
+}
+
+// Currency symbols and the number of minor digits they are printed with
+var currencies = map[string]struct {
+	symbol string
+	digits int
+}{
+	"EUR": {"€", 2},
+	"USD": {"$", 2},
+	"GBP": {"£", 2},
+	"JPY": {"¥", 0},
+	"CHF": {"CHF", 2},
+	"SEK": {"kr", 2},
+	"NOK": {"kr", 2},
+	"DKK": {"kr", 2},
+	"PLN": {"zł", 2},
+}
+
+var (
+	currencyCodeRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+	amountRegex       = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+)
+
+// Format a "EUR,1234.5" token body as a currency amount
+func formatCurrency(body, locale string) (string, bool) {
+	parts := strings.Split(body, ",")
+	if len(parts) != 2 {
+		return "", false
+	}
+	code := strings.ToUpper(strings.TrimSpace(parts[0]))
+	amount := strings.TrimSpace(parts[1])
+	if !currencyCodeRegex.MatchString(code) || !amountRegex.MatchString(amount) {
+		return "", false // ParseFloat would also take NaN, Inf and exponents
+	}
+	value, err := strconv.ParseFloat(amount, 64)
 	if err != nil {
-		return input // return original on error
+		return "", false
 	}
 
-	var layout string
-	if is12HourFormat {
-		// 12-hour format
-		layout = "03:04PM"
-	} else {
-		// 24-hour format
-		layout = "15:04"
+	symbol, digits := code, 2
+	if currency, ok := currencies[code]; ok {
+		symbol, digits = currency.symbol, currency.digits
 	}
 
-	formattedTime := t.Format(layout)
+	format := numberFormats[locale]
+	sign := ""
+	if math.Signbit(value) {
+		sign = "-"
+		value = -value
+	}
+	number := strconv.FormatFloat(value, 'f', digits, 64)
+	if strings.Trim(number, "0.") == "" {
+		sign = "" // -0.001 rounds to zero, not to minus zero
+	}
+	whole, fraction, _ := strings.Cut(number, ".")
+	number = groupThousands(whole, format.thousands)
+	if fraction != "" {
+		number += format.decimal + fraction
+	}
 
-	// Determine timezone offset
-	_, offset := t.Zone()
-	zone := ""
-	if strings.HasSuffix(timeStr, "Z") {
-		zone = "(+00:00)"
-	} else {
-		hours := offset / 3600
-		minutes := (offset % 3600) / 60
-		zone = fmt.Sprintf("(%+02d:%02d)", hours, minutes)
+	if format.symbolInFront {
+		if symbol == code {
+			return sign + symbol + " " + number, true
+		}
+		return sign + symbol + number, true
+	}
+	return sign + number + "\u00a0" + symbol, true
+}
+
+// Insert a separator between every group of three digits
+func groupThousands(digits, separator string) string {
+	var b strings.Builder
+	for i, r := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(separator)
+		}
+		b.WriteRune(r)
 	}
-	return formattedTime + " " + zone
+	return b.String()
 }
 
 func RemoveExtraNewLines(text string) string {
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Options as parsed from the given command-line flags
+func testOptions(t *testing.T, args ...string) options {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	readOptions := optionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := readOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+// A lookup with a few airports, enough for processing tests
+func testLookup() *AirportLookup {
+	return newAirportLookup([]Airport{
+		{Name: "Hannover Airport", Country: "DE", Municipality: "Hannover", ICAO: "EDDV", IATA: "HAJ"},
+		{Name: "Lennart Meri Tallinn Airport", Country: "EE", Municipality: "Tallinn", ICAO: "EETN", IATA: "TLL"},
+	}, true, true)
+}
+
+func TestOptionsPostProcess(t *testing.T) {
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-post-process", "snippets,headline,blank-lines"}, true},
+		{[]string{"-post-process", "blank-lines"}, true},
+		{[]string{"-post-process", "headline,blank-lines,headline"}, false},
+		{[]string{"-post-process", "blank-lines,snippets", "-headline"}, false},
+		{[]string{"-post-process", "headline,blank-lines", "-append-snippet", "footer.txt"}, false},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		readOptions := optionFlags(fs)
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readOptions(); (err == nil) != tt.ok {
+			t.Errorf("options %q: error %v, want ok %v", tt.args, err, tt.ok)
+		}
+	}
+}
+
+func TestProcessTextWithinTimeout(t *testing.T) {
+	opts := testOptions(t, "-headline", "-source-map", "map.json")
+	text := strings.Repeat("Fly #HAJ to ##EETN on D(2024-03-01T10:30+02:00)\n\n\n", 20000)
+
+	if _, ok := processTextWithin(time.Nanosecond, text, testLookup(), opts); ok {
+		t.Error("slow document was not reported as timed out")
+	}
+	result, ok := processTextWithin(0, "Fly #HAJ", testLookup(), opts)
+	if !ok || result.Text != "Hannover\n\nFly Hannover Airport" {
+		t.Errorf("processTextWithin without timeout = %q, %v", result.Text, ok)
+	}
+}
+
+func FuzzParseAirportLookup(f *testing.F) {
+	f.Add([]byte("name,iso_country,municipality,icao_code,iata_code,coordinates\n" +
+		"Hannover Airport,DE,Hannover,EDDV,HAJ,\"9.68508, 52.461101\"\n"))
+	f.Add([]byte("name,iso_country,municipality,icao_code,iata_code,coordinates,elevation_ft\n" +
+		"Tallinn Airport,EE,Tallinn,EETN,TLL,\"24.832799911499997, 59.41329956049999\",131\n" +
+		"Broken,EE,Nowhere,EE,TL,\"x\",\n"))
+	if data, err := os.ReadFile("airport-lookup.csv"); err == nil {
+		f.Add(data[:min(len(data), 4096)])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		store := newMemoryStorage()
+		store.WriteFile("lookup.csv", data)
+		for _, partial := range []bool{false, true} {
+			airportLookup, _, err := parseAirportLookup(store, "lookup.csv", nil, partial)
+			if err != nil {
+				continue
+			}
+			for _, code := range airportLookup.Codes() {
+				if _, ok := airportLookup.Get(code); !ok {
+					t.Fatalf("code %s listed but not found", code)
+				}
+			}
+		}
+	})
+}
+
+func TestParseAirportLookupCoordinates(t *testing.T) {
+	store := newMemoryStorage()
+	store.WriteFile("lookup.csv", []byte("name,iso_country,municipality,icao_code,iata_code,coordinates\n"+
+		"Hannover Airport,DE,Hannover,EDDV,HAJ,\"9.68508, 52.461101\"\n"+
+		"No Coordinates,DE,Nowhere,EDDX,XXX,\"\"\n"+
+		"Bad Coordinates,DE,Nowhere,EDDY,YYY,\"east, north\"\n"))
+
+	airportLookup, _, err := parseAirportLookup(store, "lookup.csv", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if airport, _ := airportLookup.Get("#HAJ"); !airport.HasCoordinates || airport.Latitude != 52.461101 || airport.Longitude != 9.68508 {
+		t.Errorf("#HAJ coordinates = %v, %v, %v", airport.HasCoordinates, airport.Latitude, airport.Longitude)
+	}
+	for _, code := range []string{"#XXX", "#YYY"} {
+		if airport, ok := airportLookup.Get(code); !ok || airport.HasCoordinates {
+			t.Errorf("%s: found %v, has coordinates %v", code, ok, airport.HasCoordinates)
+		}
+	}
+}
+
+func TestLoadResourcesProblems(t *testing.T) {
+	store := newMemoryStorage()
+	store.WriteFile("lookup.csv", []byte("name,iso_country,municipality,icao_code,iata_code,coordinates\n"+
+		"Hannover Airport,DE,Hannover,EDDV,HAJ,\"9.68508, 52.461101\"\n"+
+		",DE,Bremen,EDDW,BRE,\n"+
+		"Frankfurt Airport,DE,Frankfurt\n"))
+	store.WriteFile("metros.csv", []byte("metro\n"))
+
+	_, _, err := loadResources(store, "lookup.csv", testOptions(t, "-metros", "metros.csv"))
+	if err == nil {
+		t.Fatal("malformed data files were accepted")
+	}
+	for _, want := range []string{
+		"Airport lookup malformed:\n  line 3: airport name is empty\n  line 4: expected 6 fields, got 3",
+		"Metro groups malformed:\n  line 1: header must be code,metro",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestProcessTextPhoneNumbers(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"TEL(+44 (0)20 7946 0958)", "+442079460958"},
+		{"TEL(+1 (212) 555-0100)", "+12125550100"},
+		{"TEL(+1 (21a) 555-0100)", "TEL(+1 (21a) 555-0100)"},
+		{"TEL(+1 (212 555-0100)", "TEL(+1 (212 555-0100)"},
+	}
+	opts := testOptions(t)
+	for _, tt := range tests {
+		if got := processText(tt.in, testLookup(), opts).Text; got != tt.want {
+			t.Errorf("processText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatCurrency(t *testing.T) {
+	tests := []struct {
+		body, locale, want string
+		ok                 bool
+	}{
+		{"EUR,1234.5", "en", "€1,234.50", true},
+		{"EUR,1234.5", "de", "1.234,50\u00a0€", true},
+		{"EUR,1234.5", "fr", "1\u202f234,50\u00a0€", true},
+		{"EUR,1234.5", "et", "1\u00a0234,50\u00a0€", true},
+		{"usd, 1234567.891", "en", "$1,234,567.89", true},
+		{"JPY,1234.5", "en", "¥1,234", true},
+		{"JPY,1234.5", "de", "1.234\u00a0¥", true},
+		{"CHF,99", "en", "CHF 99.00", true},
+		{"XYZ,5", "en", "XYZ 5.00", true},
+		{"EUR,-12.5", "en", "-€12.50", true},
+		{"EUR,-0.001", "en", "€0.00", true},
+		{"EUR,-0", "de", "0,00\u00a0€", true},
+		{"EUR,NaN", "en", "", false},
+		{"EUR,Inf", "en", "", false},
+		{"EUR,-Inf", "en", "", false},
+		{"EUR,1e3", "en", "", false},
+		{"EUR,0x10", "en", "", false},
+		{"EUR,1.", "en", "", false},
+		{"EURO,1", "en", "", false},
+		{"EUR,1,2", "en", "", false},
+		{"EUR", "en", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := formatCurrency(tt.body, tt.locale)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("formatCurrency(%q, %q) = %q, %v, want %q, %v", tt.body, tt.locale, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestProcessTextProtectedRegions(t *testing.T) {
+	opts := testOptions(t, "-headline", "-source-map", "map.json")
+	text := "Fly #HAJ\n\n\n\n<!-- airportcodes:off -->\n\n\n\n#TLL\n<!-- airportcodes:on -->\n\n\n\nto #TLL on D(2024-03-01T10:30+02:00)\n"
+
+	result := processText(text, testLookup(), opts)
+	if want := "Fly Hannover Airport\n\n\n\n\n\n#TLL\n\n\nto Lennart Meri Tallinn Airport"; !strings.Contains(result.Text, want) {
+		t.Errorf("output %q does not keep the protected region as written", result.Text)
+	}
+	if len(result.Substitutions) != 3 {
+		t.Fatalf("got %d substitutions, want 3", len(result.Substitutions))
+	}
+	for _, sub := range result.Substitutions {
+		if sub.OutputStart < 0 || result.Text[sub.OutputStart:sub.OutputEnd] != sub.Replacement {
+			t.Errorf("%s mapped to output [%d, %d], want %q there", sub.Token, sub.OutputStart, sub.OutputEnd, sub.Replacement)
+		}
+	}
+}
+
+func TestProcessTextCountriesFiltered(t *testing.T) {
+	store := newMemoryStorage()
+	store.WriteFile("lookup.csv", []byte("name,iso_country,municipality,icao_code,iata_code,coordinates\n"+
+		"Hannover Airport,DE,Hannover,EDDV,HAJ,\"9.68508, 52.461101\"\n"+
+		"Lennart Meri Tallinn Airport,EE,Tallinn,EETN,TLL,\"24.832799, 59.413299\"\n"))
+	airportLookup, _, err := parseAirportLookup(store, "lookup.csv", map[string]bool{"EE": true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := processText("#TLL #HAJ ##EDDV #XXX", airportLookup, testOptions(t))
+	if want := "Lennart Meri Tallinn Airport #HAJ ##EDDV #XXX"; result.Text != want {
+		t.Errorf("output = %q, want %q", result.Text, want)
+	}
+	if len(result.Warnings) != 1 || result.Warnings[0].Token != "#XXX" {
+		t.Errorf("warnings = %v, want only #XXX", result.Warnings)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+// Read metro area groupings from a CSV file with a code,metro header, e.g.
+// "LHR,London" and "LGW,London". Codes are written without # and may be
+// IATA or ICAO. The headline shows the metro instead of the city for
+// grouped airports; the replaced codes in the text stay exact.
+func loadMetros(store Storage, path string) (map[string]string, error) {
+	rows, problems, err := readDataCSV(store, path, "Metro groups", 2, []string{"code", "metro"})
+	if err != nil {
+		return nil, err
+	}
+
+	metros := make(map[string]string)
+	for _, row := range rows {
+		checkAirportCode(problems, row.line, row.fields[0])
+		if row.fields[1] == "" {
+			problems.add(row.line, "metro is empty")
+		}
+		metros[row.fields[0]] = row.fields[1]
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return metros, nil
+}
+
+// The metro an airport is grouped into, if any
+func airportMetro(airport Airport, metros map[string]string) (string, bool) {
+	if metro, ok := metros[airport.IATA]; ok && airport.IATA != "" {
+		return metro, true
+	}
+	metro, ok := metros[airport.ICAO]
+	return metro, ok && airport.ICAO != ""
+}
@@ -0,0 +1,59 @@
+package main
+
+// Read display name overrides from a CSV file with a code,name,context
+// header. Codes are written without # (SVO or UUEE). Rows with an empty
+// context apply to every document, rows with a context only when it
+// matches -context, and those win over the global ones.
+func loadOverrides(store Storage, path string) ([]override, error) {
+	rows, problems, err := readDataCSV(store, path, "Airport overrides", 3, []string{"code", "name", "context"})
+	if err != nil {
+		return nil, err
+	}
+
+	var overrides []override
+	for _, row := range rows {
+		checkAirportCode(problems, row.line, row.fields[0])
+		if row.fields[1] == "" {
+			problems.add(row.line, "name is empty")
+		}
+		overrides = append(overrides, override{code: row.fields[0], name: row.fields[1], context: row.fields[2]})
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// A single row of the overrides file
+type override struct {
+	code    string
+	name    string
+	context string
+}
+
+// Rename airports in the lookup. Global overrides go first so that the
+// ones for the current context replace them. Codes missing from the
+// lookup, e.g. because of -countries, are skipped.
+func applyOverrides(airportLookup *AirportLookup, overrides []override, context string) {
+	for _, o := range overrides {
+		if o.context == "" {
+			airportLookup.rename(overrideKey(o.code), o.name, "overrides file")
+		}
+	}
+	if context == "" {
+		return
+	}
+	for _, o := range overrides {
+		if o.context == context {
+			airportLookup.rename(overrideKey(o.code), o.name, "overrides file, context "+context)
+		}
+	}
+}
+
+// Lookup key for a code written without # in the overrides file
+func overrideKey(code string) string {
+	if len(code) == 4 {
+		return "##" + code
+	}
+	return "#" + code
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// PostProcessor is a step that runs on the whole text after the tokens
+// have been replaced. Steps run in the order given by -post-process, so
+// combining them behaves the same way every time.
+type PostProcessor interface {
+	Process(text string) string
+}
+
+// OffsetMapper is implemented by post-processors that can tell where byte
+// offsets of their input end up in their output. Source maps stay accurate
+// only through steps that implement it. The offsets are sorted and are
+// moved in place, in one pass over the text.
+type OffsetMapper interface {
+	MapOffsets(text string, offsets []int)
+}
+
+// Every post-processor, in the default order
+var defaultPostProcessors = []string{"headline", "blank-lines", "snippets"}
+
+// Build the post-processor with the given name. Steps whose feature is not
+// enabled leave the text unchanged.
+func newPostProcessor(name, headline string, opts options) PostProcessor {
+	switch name {
+	case "headline":
+		return headlineStep{headline: headline}
+	case "blank-lines":
+		return blankLinesStep{}
+	case "snippets":
+		return snippetsStep{snippets: opts.snippets}
+	}
+	return nil
+}
+
+// Puts the headline above the text
+type headlineStep struct {
+	headline string
+}
+
+func (s headlineStep) Process(text string) string {
+	if s.headline == "" {
+		return text
+	}
+	return s.headline + "\n\n" + text
+}
+
+func (s headlineStep) MapOffsets(text string, offsets []int) {
+	if s.headline == "" {
+		return
+	}
+	for i := range offsets {
+		offsets[i] += len(s.headline) + 2
+	}
+}
+
+// Squeezes runs of blank lines down to a single blank line
+type blankLinesStep struct{}
+
+var blankLinesRegex = regexp.MustCompile(`\n{3,}`)
+
+func (blankLinesStep) Process(text string) string {
+	// Remove multiple consecutive blank lines
+	text = blankLinesRegex.ReplaceAllString(text, "\n\n")
+	return RemoveExtraNewLines(text)
+}
+
+func (blankLinesStep) MapOffsets(text string, offsets []int) {
+	matches := blankLinesRegex.FindAllStringIndex(text, -1)
+	removed, m := 0, 0
+	for i, offset := range offsets {
+		// Runs of newlines wholly before the offset have been squeezed
+		for m < len(matches) && offset >= matches[m][1] {
+			removed += matches[m][1] - (matches[m][0] + 2)
+			m++
+		}
+		// Offsets inside a run land where its kept part ends
+		if m < len(matches) && offset > matches[m][0]+2 {
+			offset = matches[m][0] + 2
+		}
+		offsets[i] = offset - removed
+	}
+}
+
+// Appends the snippets as separate paragraphs
+type snippetsStep struct {
+	snippets []string
+}
+
+func (s snippetsStep) Process(text string) string {
+	for _, snippet := range s.snippets {
+		if text != "" {
+			text = strings.TrimRight(text, "\n") + "\n\n"
+		}
+		text += snippet
+	}
+	return text
+}
+
+func (s snippetsStep) MapOffsets(text string, offsets []int) {
+	if len(s.snippets) == 0 || text == "" {
+		return
+	}
+	// Only trailing newlines move, and no substitution ends up in them
+	end := len(strings.TrimRight(text, "\n")) + 2
+	for i := range offsets {
+		offsets[i] = min(offsets[i], end)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Run the preflight subcommand: check everything a run with the same
+// options and files needs, print a pass/fail line per check and return
+// the process exit code.
+func runPreflight(args []string) int {
+	fs := flag.NewFlagSet("preflight", flag.ExitOnError)
+	readOptions := optionFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 3 {
+		fmt.Println("Incorrect number of arguments")
+		fmt.Println("Preflight usage:\n go run . preflight [options] ./input.txt ./output.txt ./airport-lookup.csv")
+		return 2
+	}
+	inputFile, outputFile, lookupFile := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+
+	failed := 0
+	check := func(name string, err error) {
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			failed++
+			return
+		}
+		fmt.Printf("PASS %s\n", name)
+	}
+
+	opts, err := readOptions()
+	check("options", err)
+	if err != nil {
+		fmt.Println("Preflight failed")
+		return 1
+	}
+
+	// Lookup and every data file the options name, remote ones included
+	store := newStorage(opts.http)
+	airportLookup, opts, err := loadResources(store, lookupFile, opts)
+	if err == nil && airportLookup.Len() == 0 {
+		err = fmt.Errorf("no airports loaded")
+	}
+	check("lookup and data files"+remoteNote(lookupFile), err)
+
+	_, err = store.ReadFile(inputFile)
+	if err != nil {
+		err = fmt.Errorf("%s not readable", inputFile)
+	}
+	check("input"+remoteNote(inputFile), err)
+
+	if opts.encryptKeyFile != "" {
+		_, err = loadPassphrase(store, opts.encryptKeyFile)
+		check("encryption passphrase", err)
+	}
+
+	outputs := []string{outputFile, opts.explainFile, opts.sourceMapFile}
+	for _, output := range outputs {
+		if output != "" {
+			check("output "+output+" writable", checkWritable(output, opts.mkdirs))
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("Preflight failed: %d check(s)\n", failed)
+		return 1
+	}
+	fmt.Println("Preflight passed")
+	return 0
+}
+
+// Label for checks that go over the network
+func remoteNote(name string) string {
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		return " (remote)"
+	}
+	return ""
+}
+
+// Check that a file can be created next to the output. With mkdirs the
+// directory may not exist yet, so the closest existing parent is tried.
+func checkWritable(outputFile string, mkdirs bool) error {
+	if remoteNote(outputFile) != "" {
+		return fmt.Errorf("remote outputs are not supported")
+	}
+
+	dir := filepath.Dir(outputFile)
+	for mkdirs {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	probe, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("cannot create files in %s", dir)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Words used to pad generated sentences between tokens
+var sampleWords = strings.Fields(`your flight departs from and arrives at on the
+	please check in before at least hours connection via terminal gate boarding
+	closes return trip outbound inbound passenger booking confirmed schedule
+	change local time arrival departure transfer seat baggage allowance fare`)
+
+// Run the gen-sample subcommand: write a synthetic itinerary built from
+// codes in the lookup. The same seed always gives the same document.
+// Returns the process exit code.
+func runGenSample(args []string) int {
+	fs := flag.NewFlagSet("gen-sample", flag.ExitOnError)
+	seed := fs.Int64("seed", 1, "Random seed")
+	lines := fs.Int("lines", 20, "Number of lines to generate")
+	density := fs.Float64("density", 0.3, "Share of words that are tokens, between 0 and 1")
+	httpOpts := httpFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Println("Incorrect number of arguments")
+		fmt.Println("Sample usage:\n go run . gen-sample [-seed N] [-lines N] [-density F] ./airport-lookup.csv ./sample.txt")
+		return 2
+	}
+	if *lines < 0 || *density < 0 || *density > 1 {
+		fmt.Println("Invalid sample size or density")
+		return 2
+	}
+
+	store := newStorage(*httpOpts)
+	airportLookup, _, err := parseAirportLookup(store, fs.Arg(0), nil, false)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	sample := generateSample(airportLookup, rand.New(rand.NewSource(*seed)), *lines, *density)
+	if err := store.WriteFile(fs.Arg(1), []byte(sample)); err != nil {
+		fmt.Println("Error writing to output file")
+		return 1
+	}
+	return 0
+}
+
+// Build the sample text. Codes come sorted, so the output only depends on
+// the seed.
+func generateSample(airportLookup *AirportLookup, rng *rand.Rand, lines int, density float64) string {
+	codes := airportLookup.Codes()
+
+	var b strings.Builder
+	for i := 0; i < lines; i++ {
+		words := 6 + rng.Intn(10)
+		for j := 0; j < words; j++ {
+			if j > 0 {
+				b.WriteByte(' ')
+			}
+			if rng.Float64() < density {
+				b.WriteString(sampleToken(codes, rng))
+			} else {
+				b.WriteString(sampleWords[rng.Intn(len(sampleWords))])
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// A random token of one of the supported kinds
+func sampleToken(codes []string, rng *rand.Rand) string {
+	when := time.Date(2000+rng.Intn(50), time.Month(1+rng.Intn(12)), 1+rng.Intn(28), rng.Intn(24), rng.Intn(60), 0, 0, time.UTC)
+	offset := "Z"
+	if rng.Intn(2) == 0 {
+		offset = fmt.Sprintf("%+03d:00", rng.Intn(25)-12)
+	}
+	stamp := when.Format("2006-01-02T15:04") + offset
+
+	switch rng.Intn(6) {
+	case 0, 1:
+		if len(codes) > 0 {
+			return codes[rng.Intn(len(codes))]
+		}
+		return "#XXX"
+	case 2:
+		return "D(" + stamp + ")"
+	case 3:
+		return "T12(" + stamp + ")"
+	case 4:
+		return "T24(" + stamp + ")"
+	}
+	return fmt.Sprintf("BAG(%dPC/23KG)", rng.Intn(3))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Source map relating each substitution in the output back to the token
+// in the input. Ranges are byte offsets, end exclusive.
+type sourceMap struct {
+	Version  int              `json:"version"`
+	Input    string           `json:"input"`
+	Output   string           `json:"output"`
+	Mappings []sourceMapEntry `json:"mappings"`
+}
+
+type sourceMapEntry struct {
+	Input  [2]int `json:"input"`
+	Output [2]int `json:"output"`
+	Token  string `json:"token"`
+	Rule   string `json:"rule"`
+}
+
+// Build the JSON source map for a processed text. Tokens that were left as
+// written are included too, mapped onto their unchanged copy.
+func buildSourceMap(inputFile, outputFile string, result processResult) ([]byte, error) {
+	sm := sourceMap{Version: 1, Input: inputFile, Output: outputFile, Mappings: []sourceMapEntry{}}
+	for _, sub := range result.Substitutions {
+		if sub.OutputStart < 0 {
+			continue
+		}
+		sm.Mappings = append(sm.Mappings, sourceMapEntry{
+			Input:  [2]int{sub.InputStart, sub.InputEnd},
+			Output: [2]int{sub.OutputStart, sub.OutputEnd},
+			Token:  sub.Token,
+			Rule:   sub.Rule,
+		})
+	}
+
+	data, err := json.MarshalIndent(sm, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Error building source map")
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProcessItineraryInMemory(t *testing.T) {
+	store := newMemoryStorage()
+	store.WriteFile("lookup.csv", []byte("name,iso_country,municipality,icao_code,iata_code,coordinates\n"+
+		"Hannover Airport,DE,Hannover,EDDV,HAJ,\"9.68508, 52.461101\"\n"))
+	store.WriteFile("in/itinerary.txt", []byte("Fly from #HAJ\n\n\n\non D(2024-03-01T10:30+02:00)\n"))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	readOptions := optionFlags(fs)
+	fs.Parse([]string{"-explain", "out/explain.txt"})
+	opts, err := readOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processItinerary(store, "in/itinerary.txt", "out/itinerary.txt", "lookup.csv", opts); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.ReadFile("out/itinerary.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Fly from Hannover Airport\n\non 01 Mar 2024\n"; string(got) != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if _, err := store.ReadFile("out/explain.txt"); err != nil {
+		t.Error("explain file not written:", err)
+	}
+
+	if err := processItinerary(store, "in/missing.txt", "out/x.txt", "lookup.csv", opts); err == nil {
+		t.Error("missing input did not fail")
+	}
+}
+
+func TestProcessItineraryNoTokens(t *testing.T) {
+	store := newMemoryStorage()
+	store.WriteFile("lookup.csv", []byte("name,iso_country,municipality,icao_code,iata_code,coordinates\n"+
+		"Hannover Airport,DE,Hannover,EDDV,HAJ,\"9.68508, 52.461101\"\n"))
+	inputs := map[string]bool{
+		"Fly from #HAJ":       true,
+		"Line one\\vline two": false,
+		"<!-- airportcodes:off -->#HAJ<!-- airportcodes:on -->": false,
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	readOptions := optionFlags(fs)
+	fs.Parse([]string{"-no-tokens", "error"})
+	opts, err := readOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for input, hasTokens := range inputs {
+		store.WriteFile("in.txt", []byte(input))
+		err := processItinerary(store, "in.txt", "out.txt", "lookup.csv", opts)
+		if (err == nil) != hasTokens {
+			t.Errorf("processItinerary(%q) error = %v, want tokens found %v", input, err, hasTokens)
+		}
+	}
+}
+
+func TestProcessItineraryProvenanceSourceMap(t *testing.T) {
+	store := newMemoryStorage()
+	store.WriteFile("lookup.csv", []byte("name,iso_country,municipality,icao_code,iata_code,coordinates\n"+
+		"Hannover Airport,DE,Hannover,EDDV,HAJ,\"9.68508, 52.461101\"\n"))
+	store.WriteFile("in.txt", []byte("Fly from #HAJ on D(2024-03-01T10:30+02:00)\n"))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	readOptions := optionFlags(fs)
+	fs.Parse([]string{"-provenance", "-source-map", "map.json"})
+	opts, err := readOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processItinerary(store, "in.txt", "out.txt", "lookup.csv", opts); err != nil {
+		t.Fatal(err)
+	}
+	output, _ := store.ReadFile("out.txt")
+	data, _ := store.ReadFile("map.json")
+	var sm sourceMap
+	if err := json.Unmarshal(data, &sm); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Hannover Airport", "01 Mar 2024"}
+	if len(sm.Mappings) != len(want) {
+		t.Fatalf("got %d mappings, want %d", len(sm.Mappings), len(want))
+	}
+	for i, m := range sm.Mappings {
+		if got := string(output[m.Output[0]:m.Output[1]]); got != want[i] {
+			t.Errorf("mapping for %s points at %q, want %q", m.Token, got, want[i])
+		}
+	}
+}
+
+func TestHTTPStorageTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("Fly #HAJ"))
+	}))
+	defer server.Close()
+
+	store := newStorage(httpSettings{timeout: 50 * time.Millisecond, connectTimeout: time.Second})
+	if data, err := store.ReadFile(server.URL + "/fast"); err != nil || string(data) != "Fly #HAJ" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+	if _, err := store.ReadFile(server.URL + "/slow"); err == nil {
+		t.Error("slow download did not time out")
+	}
+}
+
+func TestHTTPStorageRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case r.URL.Path == "/down" || r.URL.Path == "/flaky" && requests < 3:
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("Fly #HAJ"))
+		}
+	}))
+	defer server.Close()
+
+	store := newStorage(httpSettings{retries: 2, retryBackoff: time.Millisecond})
+	if data, err := store.ReadFile(server.URL + "/flaky"); err != nil || string(data) != "Fly #HAJ" || requests != 3 {
+		t.Errorf("ReadFile = %q, %v after %d requests, want success after 3", data, err, requests)
+	}
+
+	requests = 0
+	if _, err := store.ReadFile(server.URL + "/missing"); err == nil || requests != 1 {
+		t.Errorf("404 gave error %v after %d requests, want a failure without retries", err, requests)
+	}
+
+	requests = 0
+	if _, err := store.ReadFile(server.URL + "/down"); err == nil || requests != 3 {
+		t.Errorf("server down gave error %v after %d requests, want a failure after 3", err, requests)
+	}
+}
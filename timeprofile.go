@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// How D, T12 and T24 tokens are read and written. Different upstream
+// systems write date-times differently, so the layouts are picked per run
+// with -time-profile instead of being fixed in the scanner.
+type timeProfile struct {
+	layouts []string // Go layouts tried in order on the token body
+	date    string   // output layout of D tokens
+	time12  string   // output layout of T12 tokens
+	time24  string   // output layout of T24 tokens
+	offset  string   // appended to times unless -hide-offset, empty when inputs carry no zone
+}
+
+var timeProfiles = map[string]timeProfile{
+	// What the booking exports have always used: 2024-03-01T10:30+02:00
+	"default": {
+		layouts: []string{"2006-01-02T15:04-07:00", "2006-01-02T15:04Z"},
+		date:    "02 Jan 2006",
+		time12:  "03:04PM",
+		time24:  "15:04",
+		offset:  " (-07:00)",
+	},
+	// GDS screens: 01MAR24 1030, always local time without a zone
+	"gds": {
+		layouts: []string{"02Jan06 1504", "02Jan2006 1504"},
+		date:    "02 Jan 2006",
+		time12:  "3:04PM",
+		time24:  "15:04",
+	},
+	// RFC 3339 with seconds and nothing else
+	"iso-strict": {
+		layouts: []string{time.RFC3339},
+		date:    "2006-01-02",
+		time12:  "03:04PM",
+		time24:  "15:04",
+		offset:  " (Z07:00)",
+	},
+}
+
+// Parse the date-time inside a D, T12 or T24 token
+func (p timeProfile) parse(s string) (time.Time, bool) {
+	for _, layout := range p.layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Format a parsed D, T12 or T24 token
+func (p timeProfile) format(kind tokenKind, t time.Time, hideOffset bool) string {
+	layout := p.date
+	switch kind {
+	case tokenTime12:
+		layout = p.time12
+	case tokenTime24:
+		layout = p.time24
+	}
+	if kind != tokenDate && !hideOffset {
+		layout += p.offset
+	}
+	return t.Format(layout)
+}
+
+// Read extra time profiles from a CSV file with a name,field,value header.
+// Fields are layout (can be repeated), date, time12, time24 and offset, all
+// written as Go time layouts; the ones a profile leaves out are taken from
+// the default profile. A name may also redefine a built-in profile.
+func loadTimeProfiles(store Storage, path string) (map[string]timeProfile, error) {
+	rows, problems, err := readDataCSV(store, path, "Time profiles", 3, []string{"name", "field", "value"})
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []string{"layout", "date", "time12", "time24", "offset"}
+	profiles := make(map[string]timeProfile)
+	for name, profile := range timeProfiles {
+		profiles[name] = profile
+	}
+	defined := make(map[string]int) // line each profile starts on
+	for _, row := range rows {
+		name, field, value := row.fields[0], row.fields[1], row.fields[2]
+		if name == "" {
+			problems.add(row.line, "name is empty")
+			continue
+		}
+		if defined[name] == 0 {
+			profile := timeProfiles["default"]
+			profile.layouts = nil
+			profiles[name] = profile
+			defined[name] = row.line
+		}
+
+		profile := profiles[name]
+		switch field {
+		case "layout":
+			profile.layouts = append(slices.Clip(profile.layouts), value)
+		case "date":
+			profile.date = value
+		case "time12":
+			profile.time12 = value
+		case "time24":
+			profile.time24 = value
+		case "offset":
+			profile.offset = value
+		default:
+			if guess, ok := suggest(field, fields); ok {
+				problems.add(row.line, "unknown field %q, did you mean %q?", field, guess)
+			} else {
+				problems.add(row.line, "unknown field %q, must be one of %s", field, strings.Join(fields, ", "))
+			}
+		}
+		profiles[name] = profile
+	}
+
+	for name, line := range defined {
+		if len(profiles[name].layouts) == 0 {
+			problems.add(line, "profile %q has no layout rows", name)
+		}
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// Names of the profiles, for error messages
+func profileNames(profiles map[string]timeProfile) string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// Pick the profile named by -time-profile
+func selectTimeProfile(profiles map[string]timeProfile, name string) (timeProfile, error) {
+	profile, ok := profiles[name]
+	if !ok {
+		return timeProfile{}, fmt.Errorf("Invalid time profile %q, must be one of %s", name, profileNames(profiles))
+	}
+	return profile, nil
+}
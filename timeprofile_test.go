@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTimeProfiles(t *testing.T) {
+	tests := []struct {
+		profile, body string
+		kind          tokenKind
+		hideOffset    bool
+		want          string
+	}{
+		{"default", "2024-03-01T10:30+02:00", tokenDate, false, "01 Mar 2024"},
+		{"default", "2024-03-01T22:30+02:00", tokenTime12, false, "10:30PM (+02:00)"},
+		{"default", "2024-03-01T10:30Z", tokenTime24, false, "10:30 (+00:00)"},
+		{"default", "2024-03-01T10:30Z", tokenTime24, true, "10:30"},
+		{"gds", "01MAR24 1030", tokenDate, false, "01 Mar 2024"},
+		{"gds", "01MAR2024 2230", tokenTime12, false, "10:30PM"},
+		{"gds", "01MAR24 1030", tokenTime24, false, "10:30"},
+		{"iso-strict", "2024-03-01T10:30:00Z", tokenDate, false, "2024-03-01"},
+		{"iso-strict", "2024-03-01T10:30:00+02:00", tokenTime24, false, "10:30 (+02:00)"},
+		{"iso-strict", "2024-03-01T10:30:00Z", tokenTime24, false, "10:30 (Z)"},
+	}
+	for _, tt := range tests {
+		parsed, ok := timeProfiles[tt.profile].parse(tt.body)
+		if !ok {
+			t.Errorf("%s: could not parse %q", tt.profile, tt.body)
+			continue
+		}
+		if got := timeProfiles[tt.profile].format(tt.kind, parsed, tt.hideOffset); got != tt.want {
+			t.Errorf("%s: %q formatted as %q, want %q", tt.profile, tt.body, got, tt.want)
+		}
+	}
+
+	for profile, body := range map[string]string{
+		"default":    "2024-03-01T10:30:00Z",
+		"gds":        "2024-03-01T10:30Z",
+		"iso-strict": "2024-03-01T10:30Z",
+	} {
+		if _, ok := timeProfiles[profile].parse(body); ok {
+			t.Errorf("%s: parsed %q written for another profile", profile, body)
+		}
+	}
+}
+
+func TestLoadTimeProfiles(t *testing.T) {
+	store := newMemoryStorage()
+	store.WriteFile("profiles.csv", []byte("name,field,value\n"+
+		"sabre,layout,02Jan 1504\n"+
+		"sabre,layout,02Jan06 1504\n"+
+		"sabre,date,Mon 02 Jan\n"+
+		"default,layout,2006-01-02 15:04\n"))
+
+	profiles, err := loadTimeProfiles(store, "profiles.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sabre, err := selectTimeProfile(profiles, "sabre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, ok := sabre.parse("01MAR24 1030")
+	if !ok {
+		t.Fatal("sabre profile did not parse its second layout")
+	}
+	if got := sabre.format(tokenDate, parsed, false); got != "Fri 01 Mar" {
+		t.Errorf("sabre date = %q, want %q", got, "Fri 01 Mar")
+	}
+	if got := sabre.format(tokenTime24, parsed, false); got != "10:30 (+00:00)" {
+		t.Errorf("sabre time falls back to %q, want the default layouts", got)
+	}
+
+	// Redefining a built-in profile replaces its layouts
+	profile, _ := selectTimeProfile(profiles, "default")
+	if _, ok := profile.parse("2024-03-01T10:30+02:00"); ok {
+		t.Error("redefined default profile still parses its built-in layouts")
+	}
+	if _, ok := profile.parse("2024-03-01 10:30"); !ok {
+		t.Error("redefined default profile does not parse its new layout")
+	}
+	if profile, _ := selectTimeProfile(profiles, "gds"); len(profile.layouts) != 2 {
+		t.Error("built-in profiles not kept alongside the loaded ones")
+	}
+
+	_, err = selectTimeProfile(profiles, "sabr")
+	if err == nil || !strings.Contains(err.Error(), "default, gds, iso-strict, sabre") {
+		t.Errorf("unknown profile error = %v, want the profile names", err)
+	}
+}
+
+func TestLoadTimeProfilesProblems(t *testing.T) {
+	store := newMemoryStorage()
+	store.WriteFile("profiles.csv", []byte("name,field,value\n"+
+		"sabre,dat,Mon 02 Jan\n"+
+		",layout,02Jan 1504\n"+
+		"amadeus,offset, (-07:00)\n"))
+
+	_, err := loadTimeProfiles(store, "profiles.csv")
+	want := "Time profiles malformed:\n" +
+		"  line 2: unknown field \"dat\", did you mean \"date\"?\n" +
+		"  line 2: profile \"sabre\" has no layout rows\n" +
+		"  line 3: name is empty\n" +
+		"  line 4: profile \"amadeus\" has no layout rows"
+	if err == nil || err.Error() != want {
+		t.Errorf("loadTimeProfiles error = %v, want %q", err, want)
+	}
+
+	if _, err := loadTimeProfiles(store, "missing.csv"); err == nil {
+		t.Error("missing profiles file did not fail")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Longest body accepted between a token's parentheses. Anything longer is
+// left in the text as-is, so a stray "D(" can't swallow a whole document.
+const maxTokenBody = 256
+
+type tokenKind int
+
+const (
+	tokenICAO      tokenKind = iota // ##EDDW
+	tokenIATA                       // #HAJ
+	tokenDate                       // D(...)
+	tokenTime12                     // T12(...)
+	tokenTime24                     // T24(...)
+	tokenPNR                        // PNR(...)
+	tokenTicket                     // TKT(...)
+	tokenCurrency                   // CUR(...)
+	tokenPhone                      // TEL(...)
+	tokenBaggage                    // BAG(...)
+	tokenSeat                       // ST(14A) or NSST 14A
+	tokenCodeshare                  // OPERATED BY ...
+	tokenFlight                     // FLT(...)
+	tokenLineBreak                  // \v, \f or \r written out as two characters
+)
+
+// A token found in the input text
+type token struct {
+	kind  tokenKind
+	start int    // byte offset of the first character
+	end   int    // byte offset just past the last character
+	body  string // code, text between the parentheses, seat or carrier
+}
+
+// Tokens written as PREFIX(body)
+var parenTokens = []struct {
+	prefix string
+	kind   tokenKind
+}{
+	{"D(", tokenDate},
+	{"T12(", tokenTime12},
+	{"T24(", tokenTime24},
+	{"PNR(", tokenPNR},
+	{"TKT(", tokenTicket},
+	{"CUR(", tokenCurrency},
+	{"TEL(", tokenPhone},
+	{"BAG(", tokenBaggage},
+	{"ST(", tokenSeat},
+	{"FLT(", tokenFlight},
+}
+
+var (
+	gdsSeatRegex   = regexp.MustCompile(`^NSST\s+(\d{1,3}[A-Z])\b`)
+	seatRegex      = regexp.MustCompile(`^\d{1,3}[A-Z]$`)
+	codeshareRegex = regexp.MustCompile(`^OPERATED BY\s*/?\s*([A-Z0-9][A-Z0-9&.' -]*[A-Z0-9.])`)
+)
+
+// Find all tokens in text, left to right and without overlaps. Malformed
+// tokens (unclosed, nested, too long) are skipped and stay in the text.
+func scanTokens(text string) []token {
+	tokens, _ := scanTokensBefore(text, time.Time{})
+	return tokens
+}
+
+// scanTokens, giving up with false once the deadline has passed (never
+// when it is zero)
+func scanTokensBefore(text string, deadline time.Time) ([]token, bool) {
+	var tokens []token
+	for i, steps := 0, 0; i < len(text); steps++ {
+		if steps%4096 == 0 && pastDeadline(deadline) {
+			return nil, false
+		}
+		tok, ok := scanTokenAt(text, i)
+		if !ok {
+			i++
+			continue
+		}
+		tokens = append(tokens, tok)
+		i = tok.end
+	}
+	return tokens, true
+}
+
+// Try to read a token starting exactly at offset i
+func scanTokenAt(text string, i int) (token, bool) {
+	rest := text[i:]
+	switch rest[0] {
+	case '\\':
+		if len(rest) > 1 && (rest[1] == 'v' || rest[1] == 'f' || rest[1] == 'r') {
+			return token{kind: tokenLineBreak, start: i, end: i + 2, body: rest[:2]}, true
+		}
+		return token{}, false
+
+	case '#':
+		if strings.HasPrefix(rest, "##") {
+			if isCode(rest[2:], 4) {
+				return token{kind: tokenICAO, start: i, end: i + 6, body: rest[2:6]}, true
+			}
+			return token{}, false
+		}
+		if isCode(rest[1:], 3) {
+			return token{kind: tokenIATA, start: i, end: i + 4, body: rest[1:4]}, true
+		}
+		return token{}, false
+
+	case 'N':
+		if !startsWord(text, i) {
+			return token{}, false
+		}
+		if m := gdsSeatRegex.FindStringSubmatch(limit(rest, 32)); m != nil {
+			return token{kind: tokenSeat, start: i, end: i + len(m[0]), body: m[1]}, true
+		}
+		return token{}, false
+
+	case 'O':
+		if !startsWord(text, i) {
+			return token{}, false
+		}
+		m := codeshareRegex.FindStringSubmatchIndex(limit(rest, maxTokenBody))
+		if m == nil {
+			return token{}, false
+		}
+		// The carrier name is made of whole upper-case words, so a word the
+		// match cut short, like the D of "KLM. Departure", isn't part of it
+		end := i + m[3]
+		if end < len(text) && isWordByte(text[end]) {
+			end = i + m[2] + max(strings.LastIndexByte(text[i+m[2]:end], ' '), 0)
+		}
+		// It also ends before the next token, e.g. the T24 in
+		// "OPERATED BY AIR BALTIC T24(...)"
+		for j := i + m[2]; j < end; j++ {
+			if text[j-1] == ' ' {
+				if _, ok := scanTokenAt(text, j); ok {
+					end = j
+					break
+				}
+			}
+		}
+		body := strings.TrimRight(text[i+m[2]:end], "&' -")
+		// A full stop after the name ends the sentence, one inside the last
+		// word is an abbreviation like S.A.
+		if last := body[strings.LastIndexByte(body, ' ')+1:]; strings.Count(last, ".") == 1 && strings.HasSuffix(last, ".") {
+			body = strings.TrimRight(body[:len(body)-1], "&' -")
+		}
+		if body == "" {
+			return token{}, false
+		}
+		return token{kind: tokenCodeshare, start: i, end: i + m[2] + len(body), body: body}, true
+	}
+
+	for _, p := range parenTokens {
+		if !strings.HasPrefix(rest, p.prefix) {
+			continue
+		}
+		if p.kind == tokenSeat && !startsWord(text, i) {
+			return token{}, false
+		}
+		body, ok := parenBody(rest[len(p.prefix):], p.kind == tokenPhone)
+		if !ok {
+			return token{}, false
+		}
+		end := i + len(p.prefix) + len(body) + 1
+		return token{kind: p.kind, start: i, end: end, body: body}, true
+	}
+	return token{}, false
+}
+
+// Read a token body up to the closing parenthesis. Nested parentheses make
+// the token invalid, except around the digit groups phone numbers may
+// carry, such as the "(0)" trunk prefix or a "(212)" area code.
+func parenBody(s string, allowDigitGroups bool) (string, bool) {
+	for j := 0; j < len(s) && j <= maxTokenBody; j++ {
+		switch s[j] {
+		case ')':
+			return s[:j], j > 0
+		case '(':
+			k := j + 1
+			for k < len(s) && k-j <= 5 && s[k] >= '0' && s[k] <= '9' {
+				k++
+			}
+			if !allowDigitGroups || k == j+1 || k >= len(s) || s[k] != ')' {
+				return "", false
+			}
+			j = k
+		}
+	}
+	return "", false
+}
+
+// Report whether s starts with n upper-case letters or digits
+func isCode(s string, n int) bool {
+	if len(s) < n {
+		return false
+	}
+	for j := 0; j < n; j++ {
+		if !(s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Report whether offset i is not preceded by a letter, digit or underscore
+func startsWord(text string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	return !isWordByte(text[i-1])
+}
+
+// Report whether c can be part of a word
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// Cut s to at most n bytes
+func limit(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// Replacement text for a token, or false when the token can't be replaced
+// and should stay as written
+func replaceToken(tok token, airportLookup *AirportLookup, opts options) (string, bool) {
+	switch tok.kind {
+	case tokenICAO:
+		airport, ok := airportLookup.Get("##" + tok.body)
+		return applyNameCase(airport.Name, opts.nameCase), ok
+
+	case tokenIATA:
+		airport, ok := airportLookup.Get("#" + tok.body)
+		return applyNameCase(airport.Name, opts.nameCase), ok
+
+	case tokenDate, tokenTime12, tokenTime24:
+		t, ok := opts.timeProfile.parse(tok.body)
+		return opts.timeProfile.format(tok.kind, t, opts.hideOffset), ok
+
+	case tokenPNR:
+		pnr, ok := normalizePNR(tok.body)
+		if ok && opts.redact {
+			pnr = maskPNR(pnr)
+		}
+		return pnr, ok
+
+	case tokenTicket:
+		ticket, ok := normalizeTicketNumber(tok.body)
+		if ok && opts.redact {
+			ticket = maskTicketNumber(ticket)
+		}
+		return ticket, ok
+
+	case tokenCurrency:
+		return formatCurrency(tok.body, opts.locale)
+
+	case tokenPhone:
+		return normalizePhoneNumber(tok.body)
+
+	case tokenBaggage:
+		return expandBaggage(tok.body, opts.bagPhrases)
+
+	case tokenSeat:
+		if !seatRegex.MatchString(tok.body) {
+			return "", false
+		}
+		return formatSeat(tok.body, opts.seatLayout), true
+
+	case tokenCodeshare:
+		if name, ok := airlineName(tok.body, opts.airlines); ok {
+			return "Operated by " + name, true
+		}
+		return "Operated by " + toTitleCase(tok.body), true
+
+	case tokenFlight:
+		flight, carrier, ok := normalizeFlightNumber(tok.body)
+		if ok && opts.airlines != nil && opts.airlines[carrier] == "" {
+			return "", false // unknown carrier
+		}
+		return flight, ok
+
+	case tokenLineBreak:
+		return "\n", true
+	}
+	return "", false
+}
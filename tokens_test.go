@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func FuzzScanTokens(f *testing.F) {
+	for _, seed := range []string{
+		"Fly ##EDDW to #HAJ on D(2024-03-01T10:30+02:00) at T12(2024-03-01T10:30Z)",
+		"PNR(abc 123) TKT(125-1234567890) CUR(EUR,1234.5) TEL(+44 (0)20 7946 0958)",
+		"BAG(1PC/23KG) ST(14A) NSST 14A OPERATED BY AIR BALTIC T24(2024-03-01T10:30Z)",
+		"FLT(lh 0441)\\v\\f\\r D( D(( ##EDD #HA",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		end := 0
+		for _, tok := range scanTokens(text) {
+			if tok.start < end || tok.end <= tok.start || tok.end > len(text) {
+				t.Fatalf("token %+v out of order or bounds after offset %d in %q", tok, end, text)
+			}
+			end = tok.end
+		}
+	})
+}
+
+func TestScanCodeshareCarrier(t *testing.T) {
+	tests := []struct{ text, carrier string }{
+		{"OPERATED BY AIR BALTIC", "AIR BALTIC"},
+		{"OPERATED BY /KLM", "KLM"},
+		{"OPERATED BY AIR BALTIC T24(2024-03-01T10:30Z)", "AIR BALTIC"},
+		{"OPERATED BY KLM #AMS", "KLM"},
+		{"OPERATED BY KLM, then a bus", "KLM"},
+		{"OPERATED BY KLM. Departure at 10:30", "KLM"},
+		{"OPERATED BY KLM Departure at 10:30", "KLM"},
+		{"OPERATED BY AIR FRANCE S.A.", "AIR FRANCE S.A."},
+		{"OPERATED BY SAS.", "SAS"},
+		{"OPERATED BY Lufthansa", ""},
+	}
+	for _, tt := range tests {
+		tok, ok := scanTokenAt(tt.text, 0)
+		if tt.carrier == "" {
+			if ok {
+				t.Errorf("%q: found carrier %q, want none", tt.text, tok.body)
+			}
+			continue
+		}
+		if !ok || tok.kind != tokenCodeshare || tok.body != tt.carrier {
+			t.Errorf("%q: carrier %q, %v, want %q", tt.text, tok.body, ok, tt.carrier)
+		}
+	}
+}
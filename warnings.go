@@ -0,0 +1,49 @@
+package main
+
+import "fmt"
+
+// Kinds of warnings
+const (
+	warningUnknownCode    = "unknown-code"    // airport code not in the lookup
+	warningBadToken       = "invalid-token"   // token whose contents can't be parsed
+	warningUnknownCarrier = "unknown-carrier" // flight number of an airline not in -airlines
+)
+
+// Warning is a non-fatal problem found while processing. The text is
+// still written; the token it refers to is left as it was.
+type Warning struct {
+	Kind  string
+	Line  int    // 1-based line in the input
+	Token string // the token as written
+	Field string // path of the JSON string it was in, with -json-fields
+}
+
+func (w Warning) String() string {
+	where := fmt.Sprintf("line %d", w.Line)
+	if w.Field != "" {
+		where = fmt.Sprintf("field %s, %s", w.Field, where)
+	}
+	switch w.Kind {
+	case warningUnknownCode:
+		return fmt.Sprintf("%s: unknown airport code %s", where, w.Token)
+	case warningUnknownCarrier:
+		return fmt.Sprintf("%s: unknown airline in %s", where, w.Token)
+	}
+	return fmt.Sprintf("%s: could not convert %s", where, w.Token)
+}
+
+// Warning for a token replaceToken could not handle
+func tokenWarning(text string, tok token, line int) Warning {
+	kind := warningBadToken
+	if tok.kind == tokenIATA || tok.kind == tokenICAO {
+		kind = warningUnknownCode
+	}
+	if _, _, ok := normalizeFlightNumber(tok.body); tok.kind == tokenFlight && ok {
+		kind = warningUnknownCarrier
+	}
+	return Warning{
+		Kind:  kind,
+		Line:  line,
+		Token: text[tok.start:tok.end],
+	}
+}